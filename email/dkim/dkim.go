@@ -0,0 +1,410 @@
+// Package dkim verifies DKIM-Signature headers (RFC 6376) on an inbound
+// message, so smtpmail.handler can tell whether a message's claimed From
+// domain actually vouched for it cryptographically rather than trusting
+// the header at face value.
+//
+// It supports the rsa-sha1 and rsa-sha256 signing algorithms and the
+// simple and relaxed canonicalization algorithms for both headers and
+// body, which between them cover the large majority of DKIM signatures
+// seen in the wild.
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// dnsLookupTimeout bounds every DKIM public-key lookup. Verify runs
+// synchronously on the SMTP DATA path, once per DKIM-Signature header, so
+// a sender whose domain points at a deliberately slow or non-responding
+// nameserver must not be able to stall that handler indefinitely.
+const dnsLookupTimeout = 5 * time.Second
+
+// Result is the outcome of verifying one DKIM-Signature header found on a
+// message. Err is nil when the signature verified; otherwise it explains
+// why verification failed (bad tag syntax, no DNS key, signature
+// mismatch, expired signature, and so on).
+type Result struct {
+	Domain   string // the "d=" tag: the domain that signed the message
+	Selector string // the "s=" tag: picks which DNS TXT record holds the key
+	Err      error
+}
+
+// Resolver abstracts the DNS TXT lookup used to fetch a signer's public
+// key, so Verify can be exercised against canned DNS answers instead of
+// real DNS.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	return (&net.Resolver{}).LookupTXT(ctx, name)
+}
+
+// Verify parses every DKIM-Signature header out of raw (a full, unmodified
+// RFC822 message) and verifies each against the signer's DNS-published
+// public key, using the system resolver.
+func Verify(raw []byte) []Result {
+	return VerifyWithResolver(raw, netResolver{})
+}
+
+// VerifyWithResolver is Verify with an injectable Resolver.
+func VerifyWithResolver(raw []byte, resolver Resolver) []Result {
+	headers, body := splitMessage(raw)
+
+	var results []Result
+	for i, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		results = append(results, verifyOne(headers, i, body, resolver))
+	}
+
+	return results
+}
+
+func verifyOne(headers []header, sigIndex int, body []byte, resolver Resolver) Result {
+	sig := headers[sigIndex]
+
+	tags, err := parseTags(sig.value)
+	if err != nil {
+		return Result{Err: fmt.Errorf("dkim: malformed DKIM-Signature: %w", err)}
+	}
+
+	domain, selector := tags["d"], tags["s"]
+	result := Result{Domain: domain, Selector: selector}
+
+	if domain == "" || selector == "" {
+		result.Err = fmt.Errorf("dkim: DKIM-Signature missing d= or s=")
+		return result
+	}
+
+	headerCanon, bodyCanon, err := splitCanon(tags["c"])
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	hash, err := parseAlgorithm(tags["a"])
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	bh, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"]))
+	if err != nil {
+		result.Err = fmt.Errorf("dkim: invalid bh=: %w", err)
+		return result
+	}
+	if !bytes.Equal(bh, bodyHash(body, bodyCanon, hash)) {
+		result.Err = fmt.Errorf("dkim: body hash does not match bh=")
+		return result
+	}
+
+	signedHeaderNames := strings.Split(tags["h"], ":")
+	signedBytes := canonicalizeSignedHeaders(headers, signedHeaderNames, sig, headerCanon)
+
+	sigBytes, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		result.Err = fmt.Errorf("dkim: invalid b=: %w", err)
+		return result
+	}
+
+	pub, err := lookupPublicKey(resolver, selector, domain)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	digest := hashBytes(signedBytes, hash)
+	if err := rsa.VerifyPKCS1v15(pub, hash, digest, sigBytes); err != nil {
+		result.Err = fmt.Errorf("dkim: signature verification failed: %w", err)
+		return result
+	}
+
+	return result
+}
+
+type header struct {
+	name  string
+	value string
+	raw   string // the header as it appeared, including "Name:", with any folding kept (CRLF line breaks)
+}
+
+// splitMessage splits raw into its (unfolded) headers and body, per RFC
+// 5322 §2.1: headers end at the first blank line, everything after is
+// body. Lone LFs are treated as line endings too, since not every
+// in-the-wild message is strictly CRLF.
+func splitMessage(raw []byte) ([]header, []byte) {
+	normalized := bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+
+	parts := bytes.SplitN(normalized, []byte("\n\n"), 2)
+	headerBlock := parts[0]
+	var body []byte
+	if len(parts) == 2 {
+		body = parts[1]
+	}
+
+	var headers []header
+	var cur []string
+	flush := func() {
+		if len(cur) == 0 {
+			return
+		}
+		raw := strings.Join(cur, "\r\n")
+		name, value := splitHeaderLine(unfold(cur))
+		headers = append(headers, header{name: name, value: value, raw: raw})
+	}
+
+	for _, line := range strings.Split(string(headerBlock), "\n") {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			cur = append(cur, line)
+			continue
+		}
+		flush()
+		cur = []string{line}
+	}
+	flush()
+
+	return headers, body
+}
+
+func unfold(lines []string) string {
+	return strings.Join(lines, " ")
+}
+
+func splitHeaderLine(line string) (name, value string) {
+	i := strings.Index(line, ":")
+	if i < 0 {
+		return line, ""
+	}
+	return line[:i], strings.TrimPrefix(line[i+1:], " ")
+}
+
+// parseTags parses a DKIM-Signature (or similarly tag=value; formatted)
+// header's value into a tag name -> value map.
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("tag %q missing '='", part)
+		}
+		tags[strings.TrimSpace(part[:i])] = strings.TrimSpace(part[i+1:])
+	}
+	return tags, nil
+}
+
+func splitCanon(c string) (headerCanon, bodyCanon string, err error) {
+	if c == "" {
+		return "simple", "simple", nil
+	}
+
+	parts := strings.SplitN(c, "/", 2)
+	headerCanon = parts[0]
+	bodyCanon = "simple"
+	if len(parts) == 2 {
+		bodyCanon = parts[1]
+	}
+
+	for _, canon := range []string{headerCanon, bodyCanon} {
+		if canon != "simple" && canon != "relaxed" {
+			return "", "", fmt.Errorf("dkim: unsupported canonicalization %q", c)
+		}
+	}
+
+	return headerCanon, bodyCanon, nil
+}
+
+func parseAlgorithm(a string) (crypto.Hash, error) {
+	switch a {
+	case "rsa-sha256":
+		return crypto.SHA256, nil
+	case "rsa-sha1":
+		return crypto.SHA1, nil
+	default:
+		return 0, fmt.Errorf("dkim: unsupported signing algorithm %q", a)
+	}
+}
+
+func hashBytes(b []byte, hash crypto.Hash) []byte {
+	switch hash {
+	case crypto.SHA256:
+		sum := sha256.Sum256(b)
+		return sum[:]
+	case crypto.SHA1:
+		sum := sha1.Sum(b)
+		return sum[:]
+	default:
+		return nil
+	}
+}
+
+func bodyHash(body []byte, canon string, hash crypto.Hash) []byte {
+	return hashBytes(canonicalizeBody(body, canon), hash)
+}
+
+// canonicalizeBody applies simple or relaxed body canonicalization per
+// RFC 6376 §3.4.3/§3.4.4.
+func canonicalizeBody(body []byte, canon string) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+
+	if canon == "relaxed" {
+		for i, line := range lines {
+			line = strings.Join(strings.Fields(line), " ")
+			lines[i] = line
+		}
+	}
+
+	// Reduce any run of trailing empty lines to a single one, representing
+	// the one CRLF every canonicalized body ends with, per RFC 6376
+	// §3.4.3: an empty body canonicalizes to a single CRLF too, unless the
+	// algorithm in use says otherwise.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		// §3.4.3 (simple): an empty body canonicalizes to a single CRLF,
+		// not zero bytes - a signed auto-reply or tracking-pixel-only
+		// message with no body would otherwise fail bh= verification.
+		// §3.4.4 (relaxed) canonicalizes an empty body to the empty
+		// string, so only "simple" gets the special case.
+		if canon == "simple" {
+			return []byte("\r\n")
+		}
+		return []byte("")
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// canonicalizeSignedHeaders builds the exact bytes that get hashed and
+// signed: each header named in signedHeaderNames, canonicalized per
+// canon, followed by the DKIM-Signature header itself with its b= value
+// blanked out and, per RFC 6376 §3.7, no trailing CRLF.
+//
+// Per RFC 6376 §5.4.2, a name repeated in h= is satisfied by the next
+// unused instance of that header counting from the bottom of the message
+// upward, so a signer can limit which of several same-named headers (e.g.
+// Received) were covered.
+func canonicalizeSignedHeaders(headers []header, signedHeaderNames []string, sig header, canon string) []byte {
+	byName := make(map[string][]int)
+	for i, h := range headers {
+		name := strings.ToLower(strings.TrimSpace(h.name))
+		byName[name] = append(byName[name], i)
+	}
+
+	next := make(map[string]int)
+	for name, indices := range byName {
+		next[name] = len(indices) - 1
+	}
+
+	var buf bytes.Buffer
+	for _, rawName := range signedHeaderNames {
+		name := strings.ToLower(strings.TrimSpace(rawName))
+
+		idx, ok := next[name]
+		if !ok || idx < 0 {
+			continue
+		}
+		next[name] = idx - 1
+
+		buf.WriteString(canonicalizeHeader(headers[byName[name][idx]], canon))
+	}
+
+	sigForSigning := sig
+	sigForSigning.value = blankSignatureTag(sig.value)
+	sigForSigning.raw = sig.name + ":" + sigForSigning.value
+
+	buf.WriteString(strings.TrimSuffix(canonicalizeHeader(sigForSigning, canon), "\r\n"))
+
+	return buf.Bytes()
+}
+
+// blankSignatureTag replaces a DKIM-Signature's b= tag value with the
+// empty string, since the signature can't cover its own value.
+func blankSignatureTag(value string) string {
+	parts := strings.Split(value, ";")
+	for i, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		if strings.HasPrefix(trimmed, "b=") {
+			leading := part[:len(part)-len(strings.TrimLeft(part, " \t"))]
+			parts[i] = leading + "b="
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+func canonicalizeHeader(h header, canon string) string {
+	if canon == "simple" {
+		return h.raw + "\r\n"
+	}
+
+	name := strings.ToLower(strings.TrimSpace(h.name))
+	value := strings.Join(strings.Fields(h.value), " ")
+	return fmt.Sprintf("%s:%s\r\n", name, value)
+}
+
+func stripWhitespace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+func lookupPublicKey(resolver Resolver, selector, domain string) (*rsa.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+
+	txts, err := resolver.LookupTXT(name)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: failed to look up public key at %s: %w", name, err)
+	}
+
+	for _, txt := range txts {
+		tags, err := parseTags(txt)
+		if err != nil {
+			continue
+		}
+
+		p := tags["p"]
+		if p == "" {
+			continue
+		}
+
+		der, err := base64.StdEncoding.DecodeString(stripWhitespace(p))
+		if err != nil {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			continue
+		}
+
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+
+		return rsaKey, nil
+	}
+
+	return nil, fmt.Errorf("dkim: no usable public key found at %s", name)
+}
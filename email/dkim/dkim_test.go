@@ -0,0 +1,140 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fakeResolver answers LookupTXT with a canned set of records keyed by
+// name, so Verify can be exercised without real DNS.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(name string) ([]string, error) {
+	txts, ok := r[name]
+	if !ok {
+		return nil, fmt.Errorf("fakeResolver: no record for %s", name)
+	}
+	return txts, nil
+}
+
+// signFixture builds a minimal RFC822 message with a body and From/To/
+// Subject headers, signs it with key under domain/selector using the given
+// canonicalizations, and returns the raw bytes plus a resolver that'll
+// answer the corresponding DNS TXT lookup with key's public half.
+func signFixture(t *testing.T, key *rsa.PrivateKey, domain, selector, headerCanon, bodyCanon, body string) ([]byte, Resolver) {
+	t.Helper()
+
+	bh := base64.StdEncoding.EncodeToString(bodyHash([]byte(body), bodyCanon, crypto.SHA256))
+
+	sigValue := fmt.Sprintf("v=1; a=rsa-sha256; c=%s/%s; d=%s; s=%s; h=from:to:subject; bh=%s; b=",
+		headerCanon, bodyCanon, domain, selector, bh)
+
+	raw := "From: alice@" + domain + "\r\n" +
+		"To: bob@example.net\r\n" +
+		"Subject: hello\r\n" +
+		"DKIM-Signature: " + sigValue + "\r\n" +
+		"\r\n" + body
+
+	headers, _ := splitMessage([]byte(raw))
+
+	sigIndex := -1
+	for i, h := range headers {
+		if strings.EqualFold(h.name, "DKIM-Signature") {
+			sigIndex = i
+		}
+	}
+	if sigIndex < 0 {
+		t.Fatalf("signFixture: no DKIM-Signature header found in constructed raw message")
+	}
+
+	signedBytes := canonicalizeSignedHeaders(headers, []string{"from", "to", "subject"}, headers[sigIndex], headerCanon)
+	digest := hashBytes(signedBytes, crypto.SHA256)
+
+	sigBytes, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	if err != nil {
+		t.Fatalf("signFixture: failed to sign: %v", err)
+	}
+
+	raw = strings.Replace(raw, sigValue, sigValue+base64.StdEncoding.EncodeToString(sigBytes), 1)
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("signFixture: failed to marshal public key: %v", err)
+	}
+
+	name := selector + "._domainkey." + domain
+	resolver := fakeResolver{name: {"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)}}
+
+	return []byte(raw), resolver
+}
+
+func TestVerifyWithResolverGoodSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	raw, resolver := signFixture(t, key, "example.com", "sel", "relaxed", "simple", "Hello, world!\r\n")
+
+	results := VerifyWithResolver(raw, resolver)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Errorf("expected signature to verify, got error: %v", results[0].Err)
+	}
+	if results[0].Domain != "example.com" || results[0].Selector != "sel" {
+		t.Errorf("got domain=%q selector=%q, want example.com/sel", results[0].Domain, results[0].Selector)
+	}
+}
+
+func TestVerifyWithResolverTamperedBody(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	raw, resolver := signFixture(t, key, "example.com", "sel", "relaxed", "simple", "Hello, world!\r\n")
+
+	tampered := strings.Replace(string(raw), "Hello, world!", "Hello, mallory!", 1)
+
+	results := VerifyWithResolver([]byte(tampered), resolver)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Err == nil {
+		t.Errorf("expected tampered body to fail verification, got nil error")
+	}
+}
+
+func TestVerifyWithResolverEmptyBody(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	raw, resolver := signFixture(t, key, "example.com", "sel", "relaxed", "simple", "")
+
+	results := VerifyWithResolver(raw, resolver)
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	if results[0].Err != nil {
+		t.Errorf("expected empty-body signature to verify, got error: %v", results[0].Err)
+	}
+}
+
+func TestCanonicalizeBodyEmpty(t *testing.T) {
+	if got := canonicalizeBody([]byte(""), "simple"); string(got) != "\r\n" {
+		t.Errorf("canonicalizeBody(\"\", simple) = %q, want %q", got, "\r\n")
+	}
+	if got := canonicalizeBody([]byte(""), "relaxed"); string(got) != "" {
+		t.Errorf("canonicalizeBody(\"\", relaxed) = %q, want empty", got)
+	}
+}
@@ -0,0 +1,195 @@
+// Package dmarc evaluates DMARC (RFC 7489) alignment for an inbound
+// message: given the already-computed SPF and DKIM results, it fetches
+// the From domain's _dmarc TXT record and decides whether the message
+// passes, and if not, which policy the domain asked receivers to apply.
+package dmarc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsLookupTimeout bounds the DMARC TXT lookup. Evaluate runs
+// synchronously on the SMTP DATA path, so a domain with a deliberately
+// slow or non-responding nameserver must not be able to stall that
+// handler indefinitely.
+const dnsLookupTimeout = 5 * time.Second
+
+// Policy is the disposition a domain's DMARC record asks receivers to
+// apply to a message that fails alignment.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Record is a parsed DMARC TXT record.
+type Record struct {
+	Policy      Policy
+	SPFRelaxed  bool // aspf=r (default) vs s
+	DKIMRelaxed bool // adkim=r (default) vs s
+	Pct         int  // pct=, defaults to 100
+}
+
+// Result is the outcome of evaluating DMARC for one message.
+type Result struct {
+	Domain  string // the From header's domain, lowercased, without a trailing dot
+	Record  Record // the domain's published policy, zero value if none was found
+	Aligned bool   // true if SPF or DKIM passed and was aligned with Domain, or if Domain has no DMARC record
+	Applied Policy // the policy DMARC says to apply: "none" if it passed or no record exists
+}
+
+// Resolver abstracts the DNS TXT lookup used to fetch a domain's DMARC
+// record, so Evaluate can be exercised against canned DNS answers.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsLookupTimeout)
+	defer cancel()
+
+	return (&net.Resolver{}).LookupTXT(ctx, name)
+}
+
+// Evaluate decides the DMARC outcome for a message whose visible From
+// header domain is fromDomain, given the envelope domain SPF was
+// evaluated against (spfDomain, only meaningful if spfPass is true) and
+// the set of domains that had a passing DKIM signature (dkimPassDomains).
+func Evaluate(fromDomain string, spfPass bool, spfDomain string, dkimPassDomains []string) Result {
+	return EvaluateWithResolver(netResolver{}, fromDomain, spfPass, spfDomain, dkimPassDomains)
+}
+
+// EvaluateWithResolver is Evaluate with an injectable Resolver.
+func EvaluateWithResolver(resolver Resolver, fromDomain string, spfPass bool, spfDomain string, dkimPassDomains []string) Result {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+
+	record, err := lookupRecord(resolver, fromDomain)
+	if err != nil {
+		// No DMARC record (or an unparsable one) means the domain hasn't
+		// opted in to DMARC: nothing to enforce.
+		return Result{Domain: fromDomain, Aligned: true, Applied: PolicyNone}
+	}
+
+	spfAligned := spfPass && domainsAligned(fromDomain, spfDomain, record.SPFRelaxed)
+
+	dkimAligned := false
+	for _, d := range dkimPassDomains {
+		if domainsAligned(fromDomain, d, record.DKIMRelaxed) {
+			dkimAligned = true
+			break
+		}
+	}
+
+	aligned := spfAligned || dkimAligned
+
+	applied := PolicyNone
+	if !aligned {
+		applied = record.Policy
+	}
+
+	return Result{
+		Domain:  fromDomain,
+		Record:  record,
+		Aligned: aligned,
+		Applied: applied,
+	}
+}
+
+// domainsAligned reports whether signed (the SPF envelope domain or a
+// DKIM d= domain) aligns with from per RFC 7489 §3.1: relaxed alignment
+// only requires matching organizational domains (the registrable
+// domain), strict alignment requires an exact match.
+func domainsAligned(from, signed string, relaxed bool) bool {
+	if signed == "" {
+		return false
+	}
+
+	from = strings.ToLower(from)
+	signed = strings.ToLower(signed)
+
+	if from == signed {
+		return true
+	}
+
+	if !relaxed {
+		return false
+	}
+
+	return organizationalDomain(from) == organizationalDomain(signed)
+}
+
+// organizationalDomain approximates RFC 7489's organizational domain as
+// the last two labels (e.g. "mail.example.com" -> "example.com"). It
+// doesn't consult the Public Suffix List, so it under-splits multi-part
+// public suffixes like "co.uk"; good enough for the common case without
+// pulling in a PSL dependency.
+func organizationalDomain(domain string) string {
+	labels := strings.Split(domain, ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+func lookupRecord(resolver Resolver, fromDomain string) (Record, error) {
+	name := "_dmarc." + fromDomain
+
+	txts, err := resolver.LookupTXT(name)
+	if err != nil {
+		return Record{}, fmt.Errorf("dmarc: failed to look up %s: %w", name, err)
+	}
+
+	for _, txt := range txts {
+		if rec, ok := parseRecord(txt); ok {
+			return rec, nil
+		}
+	}
+
+	return Record{}, fmt.Errorf("dmarc: no DMARC record found at %s", name)
+}
+
+func parseRecord(txt string) (Record, bool) {
+	if !strings.HasPrefix(strings.ToLower(txt), "v=dmarc1") {
+		return Record{}, false
+	}
+
+	rec := Record{
+		Policy:      PolicyNone,
+		SPFRelaxed:  true,
+		DKIMRelaxed: true,
+		Pct:         100,
+	}
+
+	for _, part := range strings.Split(txt, ";") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			continue
+		}
+		tag, value := strings.TrimSpace(part[:i]), strings.TrimSpace(part[i+1:])
+
+		switch tag {
+		case "p":
+			rec.Policy = Policy(strings.ToLower(value))
+		case "aspf":
+			rec.SPFRelaxed = strings.ToLower(value) != "s"
+		case "adkim":
+			rec.DKIMRelaxed = strings.ToLower(value) != "s"
+		case "pct":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 && n <= 100 {
+				rec.Pct = n
+			}
+		}
+	}
+
+	return rec, true
+}
@@ -0,0 +1,338 @@
+package imapsrv
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/bwmarrin/go-alone"
+	"github.com/emersion/go-imap"
+	imapbackend "github.com/emersion/go-imap/backend"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+)
+
+// messageUID derives a stable IMAP UID from a message's own ID, rather
+// than its position in a db.GetMessages listing. Burner inboxes expire
+// individual messages independently of each other, so a UID derived from
+// list position shifts for every later message once an earlier one
+// expires - and RFC 3501 requires a UID to keep meaning the same message
+// for the life of a mailbox's UIDVALIDITY, or a client that cached state
+// by UID silently misattributes flags/bodies after the next expiry.
+//
+// Hashing m.ID (a random UUID, not a monotonically-assigned one) can't
+// promise UIDs increase in arrival order the way a persisted per-inbox
+// counter would - there's no such counter available without a database
+// schema change - but it does guarantee the property FETCH/STORE by UID
+// actually depends on: the same message always maps to the same UID
+// regardless of what else has expired around it.
+func messageUID(id string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return h.Sum32()
+}
+
+// maxUID returns the largest messageUID among msgs, for Status to report
+// a UidNext that's at least as large as every UID currently in use.
+func maxUID(msgs []burner.Message) uint32 {
+	var max uint32
+	for _, m := range msgs {
+		if uid := messageUID(m.ID); uid > max {
+			max = uid
+		}
+	}
+	return max
+}
+
+// Backend implements github.com/emersion/go-imap/backend.Backend on top of
+// burner.Database. Every burner inbox is its own IMAP user with a single
+// INBOX mailbox; there's no concept of folders or write access since
+// burner inboxes are disposable and receive-only from the IMAP side.
+type Backend struct {
+	db     burner.Database
+	signer *goalone.Sword
+
+	// updates carries unilateral backend updates (new message notifications)
+	// to the go-imap server, which forwards them to any client IDLE-ing on
+	// the matching inbox. Implementing BackendUpdater is what makes the
+	// server do this for us; see (*Backend).Updates.
+	updates chan imapbackend.Update
+}
+
+var _ imapbackend.Backend = &Backend{}
+var _ imapbackend.BackendUpdater = &Backend{}
+
+// Login authenticates username (the inbox address) against password (the
+// signed inbox token handed out when the inbox was created).
+func (b *Backend) Login(_ *imap.ConnInfo, username, password string) (imapbackend.User, error) {
+	inbox, err := b.db.GetInboxByAddress(username)
+	if err != nil {
+		return nil, fmt.Errorf("imapsrv.Backend.Login: unknown inbox %s: %w", username, err)
+	}
+
+	if password != inboxPassword(b.signer, inbox.ID) {
+		return nil, imapbackend.ErrInvalidCredentials
+	}
+
+	return &user{db: b.db, inbox: inbox}, nil
+}
+
+// Updates returns the channel of unilateral backend updates. It's what
+// makes go-imap's server treat Backend as a imapbackend.BackendUpdater and
+// wire up IDLE support for us.
+func (b *Backend) Updates() <-chan imapbackend.Update {
+	return b.updates
+}
+
+// notifyNewMessage is called by Server.NotifyNewMessage once a message has
+// been saved for inboxID. It looks up the inbox's current message count and
+// publishes a MailboxUpdate so that any client IDLE-ing on that inbox's
+// INBOX is woken up with fresh EXISTS/RECENT responses.
+func (b *Backend) notifyNewMessage(inboxID string) error {
+	inbox, err := b.db.GetInboxByID(inboxID)
+	if err != nil {
+		return fmt.Errorf("imapsrv.Backend.notifyNewMessage: failed to get inbox: %w", err)
+	}
+
+	msgs, err := b.db.GetMessages(inboxID)
+	if err != nil {
+		return fmt.Errorf("imapsrv.Backend.notifyNewMessage: failed to get messages: %w", err)
+	}
+
+	status := imap.NewMailboxStatus("INBOX", []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+	status.Messages = uint32(len(msgs))
+	status.Recent = 1
+
+	select {
+	case b.updates <- &imapbackend.MailboxUpdate{
+		Update:        imapbackend.NewUpdate(inbox.Address, "INBOX"),
+		MailboxStatus: status,
+	}:
+	default: // nobody's listening or the buffer's full; the client will still see it on the next poll/select
+	}
+
+	return nil
+}
+
+type user struct {
+	db    burner.Database
+	inbox burner.Inbox
+}
+
+var _ imapbackend.User = &user{}
+
+func (u *user) Username() string { return u.inbox.Address }
+
+func (u *user) ListMailboxes(subscribed bool) ([]imapbackend.Mailbox, error) {
+	return []imapbackend.Mailbox{&mailbox{user: u}}, nil
+}
+
+func (u *user) GetMailbox(name string) (imapbackend.Mailbox, error) {
+	if name != "INBOX" {
+		return nil, fmt.Errorf("imapsrv.user.GetMailbox: no such mailbox %q", name)
+	}
+	return &mailbox{user: u}, nil
+}
+
+func (u *user) CreateMailbox(name string) error {
+	return fmt.Errorf("imapsrv.user.CreateMailbox: read-only backend")
+}
+
+func (u *user) DeleteMailbox(name string) error {
+	return fmt.Errorf("imapsrv.user.DeleteMailbox: read-only backend")
+}
+
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return fmt.Errorf("imapsrv.user.RenameMailbox: read-only backend")
+}
+
+func (u *user) Logout() error { return nil }
+
+// mailbox implements backend.Mailbox for the single synthetic INBOX of a
+// burner address.
+type mailbox struct {
+	user *user
+}
+
+var _ imapbackend.Mailbox = &mailbox{}
+
+func (mbx *mailbox) Name() string { return "INBOX" }
+
+func (mbx *mailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{Delimiter: "/", Name: "INBOX"}, nil
+}
+
+func (mbx *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	msgs, err := mbx.user.db.GetMessages(mbx.user.inbox.ID)
+	if err != nil {
+		return nil, fmt.Errorf("imapsrv.mailbox.Status: failed to load messages: %w", err)
+	}
+
+	status := imap.NewMailboxStatus("INBOX", items)
+	status.Messages = uint32(len(msgs))
+	status.UidNext = maxUID(msgs) + 1
+	status.UidValidity = 1
+
+	return status, nil
+}
+
+func (mbx *mailbox) SetSubscribed(subscribed bool) error { return nil }
+
+func (mbx *mailbox) Check() error { return nil }
+
+func (mbx *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	msgs, err := mbx.user.db.GetMessages(mbx.user.inbox.ID)
+	if err != nil {
+		return fmt.Errorf("imapsrv.mailbox.ListMessages: failed to load messages: %w", err)
+	}
+
+	for i, m := range msgs {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = messageUID(m.ID)
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		im, err := toIMAPMessage(m, seqNum, items)
+		if err != nil {
+			return fmt.Errorf("imapsrv.mailbox.ListMessages: failed to convert message %s: %w", m.ID, err)
+		}
+
+		ch <- im
+	}
+
+	return nil
+}
+
+// SearchMessages implements the INTERNALDATE-range criteria (SINCE, BEFORE,
+// SENTSINCE, SENTBEFORE - burner only ever has one date per message, so the
+// two pairs are treated the same) plus Not/Or composition over those.
+// Everything else a client can ask for - flag criteria (SEEN, ANSWERED,
+// ...), header/body/text search, size - isn't implemented: burner messages
+// carry no persisted flags (the backend is read-only/receive-only) and
+// search doesn't have a text index to check against, so those fields are
+// silently treated as non-restricting rather than rejected outright. A
+// client relying on them will get a broader result set than it asked for,
+// not an error.
+func (mbx *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	msgs, err := mbx.user.db.GetMessages(mbx.user.inbox.ID)
+	if err != nil {
+		return nil, fmt.Errorf("imapsrv.mailbox.SearchMessages: failed to load messages: %w", err)
+	}
+
+	var results []uint32
+	for i, m := range msgs {
+		if !matchesSearchCriteria(m, criteria) {
+			continue
+		}
+		seqNum := uint32(i + 1)
+		if uid {
+			results = append(results, messageUID(m.ID))
+		} else {
+			results = append(results, seqNum)
+		}
+	}
+
+	return results, nil
+}
+
+// matchesSearchCriteria reports whether m satisfies the date-range portion
+// of criteria; see SearchMessages's doc comment for what's deliberately not
+// checked.
+func matchesSearchCriteria(m burner.Message, criteria *imap.SearchCriteria) bool {
+	if criteria == nil {
+		return true
+	}
+
+	date := time.Unix(m.ReceivedAt, 0)
+
+	if !criteria.Since.IsZero() && date.Before(criteria.Since) {
+		return false
+	}
+	if !criteria.Before.IsZero() && !date.Before(criteria.Before) {
+		return false
+	}
+	if !criteria.SentSince.IsZero() && date.Before(criteria.SentSince) {
+		return false
+	}
+	if !criteria.SentBefore.IsZero() && !date.Before(criteria.SentBefore) {
+		return false
+	}
+
+	for _, not := range criteria.Not {
+		if matchesSearchCriteria(m, not) {
+			return false
+		}
+	}
+
+	if len(criteria.Or) > 0 {
+		matched := false
+		for _, pair := range criteria.Or {
+			if matchesSearchCriteria(m, pair[0]) || matchesSearchCriteria(m, pair[1]) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (mbx *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return fmt.Errorf("imapsrv.mailbox.CreateMessage: read-only backend")
+}
+
+func (mbx *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	return fmt.Errorf("imapsrv.mailbox.UpdateMessagesFlags: read-only backend")
+}
+
+func (mbx *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	return fmt.Errorf("imapsrv.mailbox.CopyMessages: read-only backend")
+}
+
+func (mbx *mailbox) Expunge() error { return nil }
+
+// toIMAPMessage builds a go-imap message from a stored burner.Message,
+// serving BODY[] and RFC822.SIZE from the synthetic RFC822 blob generated
+// and cached at ingest time, and BODYSTRUCTURE from parseBodyStructure,
+// which describes that blob's layout from the message's fields.
+func toIMAPMessage(m burner.Message, seqNum uint32, items []imap.FetchItem) (*imap.Message, error) {
+	im := imap.NewMessage(seqNum, items)
+	im.Uid = messageUID(m.ID)
+
+	raw := m.RFC822
+
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			im.Envelope = &imap.Envelope{
+				Date:    time.Unix(m.ReceivedAt, 0),
+				Subject: m.Subject,
+			}
+		case imap.FetchRFC822Size:
+			im.Size = uint32(len(raw))
+		case imap.FetchBodyStructure, imap.FetchBody:
+			bs, err := parseBodyStructure(m)
+			if err != nil {
+				return nil, err
+			}
+			im.BodyStructure = bs
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				continue
+			}
+			im.Body[section] = bytes.NewReader(raw)
+		}
+	}
+
+	return im, nil
+}
@@ -0,0 +1,84 @@
+// Package imapsrv exposes burner inboxes over read-only IMAP4rev1 so mail
+// clients such as Thunderbird or K-9 can be pointed at a paltamail address
+// instead of only using the web UI.
+package imapsrv
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/bwmarrin/go-alone"
+	imapbackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server wraps a go-imap server backed by a burner.Database.
+type Server struct {
+	srv        *imapserver.Server
+	listenAddr string
+	backend    *Backend
+}
+
+// NewServer creates an IMAP server listening on listenAddr. signer is the
+// same go-alone key used elsewhere to sign inbox tokens; it's reused here
+// to derive each inbox's IMAP password so no separate credential store is
+// needed.
+//
+// tlsConfig, if non-nil, makes go-imap advertise and serve STARTTLS on
+// Start's plaintext listener - without it, go-imap refuses to advertise
+// LOGIN/AUTH at all (it requires IsTLS() || AllowInsecureAuth before
+// accepting credentials), so one of tlsConfig or allowInsecureAuth is
+// required for this server to be usable by any client. Pass
+// allowInsecureAuth=true only when something else terminates TLS in
+// front of this server (e.g. a local reverse proxy on the same host) -
+// it's never safe across an untrusted network, since the inbox password
+// goes over the wire in the clear.
+func NewServer(listenAddr string, db burner.Database, signer *goalone.Sword, tlsConfig *tls.Config, allowInsecureAuth bool) *Server {
+	backend := &Backend{
+		db:      db,
+		signer:  signer,
+		updates: make(chan imapbackend.Update, 32),
+	}
+
+	srv := imapserver.New(backend)
+	srv.Addr = listenAddr
+	srv.TLSConfig = tlsConfig
+	srv.AllowInsecureAuth = tlsConfig == nil && allowInsecureAuth
+
+	return &Server{
+		srv:        srv,
+		listenAddr: listenAddr,
+		backend:    backend,
+	}
+}
+
+// Start begins serving IMAP connections in the background.
+func (s *Server) Start() error {
+	go func() {
+		if err := s.srv.ListenAndServe(); err != nil {
+			log.WithError(err).Fatal("imapsrv: failed to start server")
+		}
+	}()
+
+	return nil
+}
+
+// Stop closes the listener.
+func (s *Server) Stop() error {
+	return s.srv.Close()
+}
+
+// NotifyNewMessage is called by the SMTP handler once a message has been
+// saved for inboxID so that any client IDLE-ing on that inbox's INBOX gets
+// woken up.
+func (s *Server) NotifyNewMessage(inboxID string) {
+	if err := s.backend.notifyNewMessage(inboxID); err != nil {
+		log.WithError(err).WithField("inbox_id", inboxID).Error("imapsrv.Server.NotifyNewMessage: failed to publish update")
+	}
+}
+
+func inboxPassword(signer *goalone.Sword, inboxID string) string {
+	return fmt.Sprintf("%s", signer.Sign([]byte(inboxID)))
+}
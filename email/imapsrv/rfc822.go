@@ -0,0 +1,137 @@
+package imapsrv
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+)
+
+// BuildRFC822 synthesizes a minimal RFC822 blob for a stored message so
+// the IMAP backend can serve FETCH BODY[], BODYSTRUCTURE and RFC822.SIZE
+// without re-deriving them from the parsed fields on every request. The
+// body is a multipart/alternative text+HTML part, wrapped in an outer
+// multipart/mixed alongside one part per m.Attachments when there are
+// any - mirroring the structure the web UI already reconstructs via
+// rewriteCIDRefs, so an IMAP client sees the same attachments the web UI
+// can serve.
+//
+// smtpmail.handler calls this once per message, through the hook set with
+// SMTPMail.SetNewMessageHook, and caches the result on
+// burner.Message.RFC822 before calling SaveNewMessage.
+func BuildRFC822(m burner.Message) []byte {
+	var buf bytes.Buffer
+
+	altBoundary := "paltamail-alt-" + m.ID
+	mixedBoundary := "paltamail-mixed-" + m.ID
+
+	contentType := fmt.Sprintf("multipart/alternative; boundary=%s", altBoundary)
+	if len(m.Attachments) > 0 {
+		contentType = fmt.Sprintf("multipart/mixed; boundary=%s", mixedBoundary)
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("From", m.From)
+	header.Set("Subject", mime.QEncoding.Encode("UTF-8", m.Subject))
+	header.Set("Date", time.Unix(m.ReceivedAt, 0).UTC().Format(time.RFC1123Z))
+	header.Set("MIME-Version", "1.0")
+	header.Set("Content-Type", contentType)
+
+	for k, vs := range header {
+		for _, v := range vs {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	buf.WriteString("\r\n")
+
+	if len(m.Attachments) > 0 {
+		fmt.Fprintf(&buf, "--%s\r\n", mixedBoundary)
+		fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", altBoundary)
+	}
+
+	fmt.Fprintf(&buf, "--%s\r\n", altBoundary)
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(m.BodyPlain)
+	buf.WriteString("\r\n")
+
+	fmt.Fprintf(&buf, "--%s\r\n", altBoundary)
+	buf.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	buf.WriteString(m.BodyHTML)
+	buf.WriteString("\r\n")
+
+	fmt.Fprintf(&buf, "--%s--\r\n", altBoundary)
+
+	if len(m.Attachments) > 0 {
+		for _, a := range m.Attachments {
+			fmt.Fprintf(&buf, "--%s\r\n", mixedBoundary)
+			fmt.Fprintf(&buf, "Content-Type: %s\r\n", a.ContentType)
+			fmt.Fprintf(&buf, "Content-Transfer-Encoding: base64\r\n")
+			fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=%q\r\n\r\n", a.Filename)
+			writeBase64(&buf, a.Data)
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(&buf, "--%s--\r\n", mixedBoundary)
+	}
+
+	return buf.Bytes()
+}
+
+// writeBase64 writes data to w as base64, wrapped at the conventional
+// 76-column MIME line length.
+func writeBase64(w *bytes.Buffer, data []byte) {
+	enc := base64.StdEncoding.EncodeToString(data)
+	for len(enc) > 76 {
+		w.WriteString(enc[:76])
+		w.WriteString("\r\n")
+		enc = enc[76:]
+	}
+	w.WriteString(enc)
+	w.WriteString("\r\n")
+}
+
+// parseBodyStructure builds an *imap.BodyStructure describing the blob
+// produced by BuildRFC822: a multipart/alternative text+HTML part, plus
+// one part per attachment when m has any, wrapped in an outer
+// multipart/mixed to match.
+func parseBodyStructure(m burner.Message) (*imap.BodyStructure, error) {
+	alt := &imap.BodyStructure{
+		MIMEType:    "multipart",
+		MIMESubType: "alternative",
+		Parts: []*imap.BodyStructure{
+			{MIMEType: "text", MIMESubType: "plain", Params: map[string]string{"charset": "utf-8"}},
+			{MIMEType: "text", MIMESubType: "html", Params: map[string]string{"charset": "utf-8"}},
+		},
+	}
+
+	if len(m.Attachments) == 0 {
+		return alt, nil
+	}
+
+	mixed := &imap.BodyStructure{
+		MIMEType:    "multipart",
+		MIMESubType: "mixed",
+		Parts:       []*imap.BodyStructure{alt},
+	}
+
+	for _, a := range m.Attachments {
+		mimeType, mimeSubType := "application", "octet-stream"
+		if parts := strings.SplitN(a.ContentType, "/", 2); len(parts) == 2 {
+			mimeType, mimeSubType = parts[0], parts[1]
+		}
+
+		mixed.Parts = append(mixed.Parts, &imap.BodyStructure{
+			MIMEType:          mimeType,
+			MIMESubType:       mimeSubType,
+			Disposition:       "attachment",
+			DispositionParams: map[string]string{"filename": a.Filename},
+		})
+	}
+
+	return mixed, nil
+}
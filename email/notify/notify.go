@@ -0,0 +1,225 @@
+// Package notify fans a new message out to whatever external channel an
+// inbox was configured with, turning paltamail into an ephemeral
+// destination other tooling can watch for 2FA codes, OTPs, or just mail
+// worth an immediate ping.
+//
+// It expects burner.Inbox to carry a handful of notify_* fields set via
+// POST /inbox (NotifyWebhookURL, NotifyTelegramBotToken/ChatID,
+// NotifyChatOpURL/Platform) and that smtpmail.SMTPMail.SetNotifyHook is
+// wired to Dispatch's return value, so a notifier fires right after
+// SaveNewMessage succeeds.
+//
+// NotifyWebhookURL and NotifyChatOpURL come straight from POST /inbox,
+// i.e. from whoever created the inbox, with no further vetting - so
+// WebhookNotifier and ChatOpNotifier route every outbound request
+// through validateOutboundURL and safeHTTPClient (see ssrf.go) rather
+// than the default http.Client, to stop an inbox being used as an SSRF
+// proxy against internal services or cloud metadata endpoints.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/bwmarrin/go-alone"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Notifier forwards a preview of msg, received into inbox, to some
+// external channel.
+type Notifier interface {
+	Notify(inbox burner.Inbox, msg burner.Message) error
+}
+
+// Dispatch returns the hook smtpmail.SetNotifyHook expects: given an
+// inbox and the message just saved to it, it builds whichever notifiers
+// the inbox was configured with and fires them concurrently, logging
+// failures rather than surfacing them, so a slow or unreachable endpoint
+// never holds up SMTP ingest.
+func Dispatch(signer *goalone.Sword, websiteAddr string) func(inbox burner.Inbox, msg burner.Message) {
+	return func(inbox burner.Inbox, msg burner.Message) {
+		for _, n := range notifiersFor(inbox, signer, websiteAddr) {
+			go func(n Notifier) {
+				if err := n.Notify(inbox, msg); err != nil {
+					log.WithError(err).WithField("inbox_id", inbox.ID).Error("notify.Dispatch: notifier failed")
+				}
+			}(n)
+		}
+	}
+}
+
+func notifiersFor(inbox burner.Inbox, signer *goalone.Sword, websiteAddr string) []Notifier {
+	var notifiers []Notifier
+
+	if inbox.NotifyWebhookURL != "" {
+		notifiers = append(notifiers, &WebhookNotifier{
+			URL:         inbox.NotifyWebhookURL,
+			Signer:      signer,
+			WebsiteAddr: websiteAddr,
+		})
+	}
+
+	if inbox.NotifyTelegramBotToken != "" && inbox.NotifyTelegramChatID != "" {
+		notifiers = append(notifiers, &TelegramNotifier{
+			BotToken: inbox.NotifyTelegramBotToken,
+			ChatID:   inbox.NotifyTelegramChatID,
+		})
+	}
+
+	if inbox.NotifyChatOpURL != "" {
+		notifiers = append(notifiers, &ChatOpNotifier{
+			WebhookURL: inbox.NotifyChatOpURL,
+			Platform:   inbox.NotifyChatOpPlatform,
+		})
+	}
+
+	return notifiers
+}
+
+// bodyPreview returns a short preview of msg suitable for a chat
+// notification: the trimmed plain text body, or the HTML body when there's
+// no plain text part, cut to its first 140 bytes plus "…" when longer.
+// Line breaks inside the preview are kept.
+func bodyPreview(msg burner.Message) string {
+	const maxLen = 140
+
+	body := strings.TrimSpace(msg.BodyPlain)
+	if body == "" {
+		body = strings.TrimSpace(msg.BodyHTML)
+	}
+
+	if len(body) > maxLen {
+		body = strings.TrimSpace(body[:maxLen]) + "…"
+	}
+
+	return body
+}
+
+// WebhookNotifier POSTs a JSON envelope describing a new message to a
+// generic outgoing webhook URL. Link is HMAC-signed with the same
+// bwmarrin/go-alone signer used for inbox tokens elsewhere (see
+// imapsrv.inboxPassword), so the receiving end can't be tricked into
+// fetching someone else's mail by guessing the URL.
+type WebhookNotifier struct {
+	URL         string
+	Signer      *goalone.Sword
+	WebsiteAddr string
+}
+
+type webhookPayload struct {
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+	Preview string `json:"preview"`
+	Link    string `json:"link"`
+}
+
+func (n *WebhookNotifier) Notify(inbox burner.Inbox, msg burner.Message) error {
+	if err := validateOutboundURL(n.URL); err != nil {
+		return fmt.Errorf("notify.WebhookNotifier.Notify: %w", err)
+	}
+
+	body, err := json.Marshal(webhookPayload{
+		From:    msg.From,
+		Subject: msg.Subject,
+		Preview: bodyPreview(msg),
+		Link:    n.messageLink(inbox, msg),
+	})
+	if err != nil {
+		return fmt.Errorf("notify.WebhookNotifier.Notify: failed to marshal payload: %w", err)
+	}
+
+	resp, err := safeHTTPClient.Post(n.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("notify.WebhookNotifier.Notify: failed to POST webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify.WebhookNotifier.Notify: webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (n *WebhookNotifier) messageLink(inbox burner.Inbox, msg burner.Message) string {
+	token := fmt.Sprintf("%s", n.Signer.Sign([]byte(inbox.ID+"/"+msg.ID)))
+	return fmt.Sprintf("%s/inbox/%s/messages/%s?token=%s", n.WebsiteAddr, inbox.ID, msg.ID, token)
+}
+
+// TelegramNotifier delivers a new-message notification via the Telegram
+// Bot API's sendMessage method.
+type TelegramNotifier struct {
+	BotToken string
+	ChatID   string
+}
+
+func (n *TelegramNotifier) Notify(inbox burner.Inbox, msg burner.Message) error {
+	form := url.Values{}
+	form.Set("chat_id", n.ChatID)
+	form.Set("text", fmt.Sprintf("New mail for %s\nFrom: %s\nSubject: %s\n\n%s", inbox.Address, msg.From, msg.Subject, bodyPreview(msg)))
+
+	endpoint := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", n.BotToken)
+
+	resp, err := timeoutHTTPClient.PostForm(endpoint, form)
+	if err != nil {
+		return fmt.Errorf("notify.TelegramNotifier.Notify: failed to call sendMessage: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify.TelegramNotifier.Notify: sendMessage returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// ChatOpNotifier posts a plain-text message to a "chat-op" style incoming
+// robot webhook, the kind DingTalk, WeCom and Feishu (Lark) group chats
+// accept. Platform picks the request body shape to use, since Feishu's
+// differs from DingTalk/WeCom's.
+type ChatOpNotifier struct {
+	WebhookURL string
+	Platform   string // "dingtalk", "wecom", or "feishu"
+}
+
+func (n *ChatOpNotifier) Notify(inbox burner.Inbox, msg burner.Message) error {
+	if err := validateOutboundURL(n.WebhookURL); err != nil {
+		return fmt.Errorf("notify.ChatOpNotifier.Notify: %w", err)
+	}
+
+	text := fmt.Sprintf("New mail for %s\nFrom: %s\nSubject: %s\n\n%s", inbox.Address, msg.From, msg.Subject, bodyPreview(msg))
+
+	var payload interface{}
+	if n.Platform == "feishu" {
+		payload = map[string]interface{}{
+			"msg_type": "text",
+			"content":  map[string]string{"text": text},
+		}
+	} else {
+		payload = map[string]interface{}{
+			"msgtype": "text",
+			"text":    map[string]string{"content": text},
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("notify.ChatOpNotifier.Notify: failed to marshal payload: %w", err)
+	}
+
+	resp, err := safeHTTPClient.Post(n.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("notify.ChatOpNotifier.Notify: failed to POST webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notify.ChatOpNotifier.Notify: webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
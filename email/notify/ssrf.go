@@ -0,0 +1,124 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// privateCIDRs are the address ranges safeDialContext refuses to connect
+// to: the RFC 1918/4193 private ranges, loopback, link-local (which
+// covers the 169.254.169.254 cloud-metadata address), and a handful of
+// other non-routable ranges. net.IP's IsLoopback/IsLinkLocalUnicast/
+// IsMulticast/IsUnspecified cover the rest without needing a CIDR list.
+var privateCIDRs = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"fc00::/7",      // unique local addresses
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(fmt.Sprintf("notify: invalid CIDR %q: %v", c, err))
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// safeHTTPClient is used for every outbound request this package makes to
+// an inbox-configured URL (NotifyWebhookURL, NotifyChatOpURL) - both are
+// attacker-controlled, set by whoever created the inbox via POST /inbox
+// with no further validation at creation time. It refuses to follow
+// redirects (a redirect target deserves exactly the same scrutiny as the
+// original URL, so there's no value in chasing it) and only ever
+// connects to an IP address safeDialContext itself resolved and checked,
+// which closes the gap a separate "resolve, check, then let net/http
+// resolve again and connect" approach would leave open to DNS rebinding.
+var safeHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return fmt.Errorf("notify: refusing to follow redirect to %s", req.URL)
+	},
+	Transport: &http.Transport{
+		DialContext: safeDialContext,
+	},
+}
+
+// timeoutHTTPClient is for requests to a fixed, trusted host (api.telegram.org)
+// that isn't attacker-controlled, so it skips safeHTTPClient's SSRF dialer
+// and redirect refusal - but it still needs the same timeout: Dispatch
+// fires every notifier in its own unbounded goroutine, so a hanging
+// endpoint would otherwise leak one goroutine per stuck notification
+// forever.
+var timeoutHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+func safeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("notify: invalid address %q: %w", addr, err)
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("notify: failed to resolve %s: %w", host, err)
+	}
+
+	for _, ipAddr := range ips {
+		if !isSafeOutboundIP(ipAddr.IP) {
+			continue
+		}
+
+		dialer := net.Dialer{Timeout: 5 * time.Second}
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ipAddr.IP.String(), port))
+	}
+
+	return nil, fmt.Errorf("notify: %s resolves only to disallowed addresses", host)
+}
+
+func isSafeOutboundIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, n := range privateCIDRs {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validateOutboundURL rejects anything but a well-formed https URL.
+// WebhookNotifier and ChatOpNotifier call it at the start of Notify,
+// before making any request.
+func validateOutboundURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("notify: invalid URL %q: %w", rawURL, err)
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("notify: refusing non-https URL %q", rawURL)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("notify: URL %q has no host", rawURL)
+	}
+
+	return nil
+}
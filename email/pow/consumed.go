@@ -0,0 +1,50 @@
+package pow
+
+import (
+	"sync"
+	"time"
+)
+
+// consumedSet tracks which tokens have already been redeemed. Since every
+// token carries its own expiry, an entry only needs to be remembered until
+// that expiry passes, so a lazy sweep on write keeps this bounded without
+// needing real LRU eviction.
+type consumedSet struct {
+	mu      sync.Mutex
+	expires map[string]time.Time
+}
+
+func newConsumedSet() *consumedSet {
+	return &consumedSet{
+		expires: make(map[string]time.Time),
+	}
+}
+
+// tryConsume reports whether token was not already consumed and, if so,
+// atomically marks it consumed (until expiry) as part of the same lock
+// acquisition - so two concurrent callers racing the same solved token
+// can't both observe "not yet consumed" and each get credited for one
+// solve.
+func (c *consumedSet) tryConsume(token string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.expires[token]; ok {
+		return false
+	}
+
+	c.expires[token] = expiry
+	c.sweep()
+
+	return true
+}
+
+// sweep drops every entry whose expiry has passed. Called with mu held.
+func (c *consumedSet) sweep() {
+	now := time.Now()
+	for token, expiry := range c.expires {
+		if now.After(expiry) {
+			delete(c.expires, token)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package pow
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// creditTTL is how long a solved challenge credits the solving connection's
+// IP for (see IPGate.Allow). It's deliberately short compared to an
+// inbox's TTL so a credited IP can't coast on one solve indefinitely.
+const creditTTL = 10 * time.Minute
+
+type challengeResponse struct {
+	Token      string `json:"token"`
+	Difficulty uint8  `json:"difficulty"`
+	Expiry     int64  `json:"expiry"`
+}
+
+// RegisterChallengeRoute mounts GET /pow/challenge on r, handing out a
+// fresh Challenge for a client to solve (e.g. in a WebWorker) before
+// retrying whatever request IPGate is gating.
+func (g *IPGate) RegisterChallengeRoute(r *mux.Router) {
+	r.HandleFunc("/pow/challenge", challengeHandler(g)).Methods("GET")
+}
+
+func challengeHandler(g *IPGate) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		challenge, err := g.issuer.Issue()
+		if err != nil {
+			log.WithError(err).Error("pow.challengeHandler: failed to issue challenge")
+			http.Error(w, "failed to issue challenge", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challengeResponse{
+			Token:      challenge.Token,
+			Difficulty: challenge.Difficulty,
+			Expiry:     challenge.Expiry.Unix(),
+		})
+	}
+}
+
+// verifyRequest is the body POST /pow/verify expects: a Challenge's Token
+// as issued, and Nonce, the client's base64-encoded solution to it.
+type verifyRequest struct {
+	Token string `json:"token"`
+	Nonce string `json:"nonce"`
+}
+
+// RegisterVerifyRoute mounts POST /pow/verify on r. On a valid solution it
+// credits the requesting HTTP connection's IP (see IPGate.Credit) for
+// creditTTL.
+//
+// That credit is only useful if the IP it's recorded against - the
+// browser's IP, as seen on this HTTP connection - later shows up as the
+// connecting IP on the SMTP listener IPGate.Allow gates. That holds for a
+// relay or tool that solves its own puzzle and then submits its own mail
+// from the same address, but not for the general inbound-mail case: a
+// third-party sender's mail server (e.g. Gmail's outbound IP, forwarding
+// someone else's mail to a burner address) never solved anything and
+// never will, so SetProofOfWorkGate would reject it regardless of who
+// solved a challenge through this endpoint. Wiring SetProofOfWorkGate up
+// is only sound for deployments that control who's allowed to connect to
+// the SMTP listener in the first place; it isn't a general anti-spam
+// measure for open third-party inbound mail.
+func (g *IPGate) RegisterVerifyRoute(r *mux.Router) {
+	r.HandleFunc("/pow/verify", verifyHandler(g)).Methods("POST")
+}
+
+func verifyHandler(g *IPGate) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body verifyRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "bad request body", http.StatusBadRequest)
+			return
+		}
+
+		nonce, err := base64.StdEncoding.DecodeString(body.Nonce)
+		if err != nil {
+			http.Error(w, "nonce must be base64", http.StatusBadRequest)
+			return
+		}
+
+		if err := g.Credit(req.RemoteAddr, body.Token, nonce, creditTTL); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,85 @@
+package pow
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// IPGate credits a client IP with having solved a pow.Challenge recently,
+// so repeat connections from that IP don't have to re-solve one for every
+// message within the credit's lifetime. It's the piece smtpmail.SMTPMail
+// consults on the SMTP DATA path (see SetProofOfWorkGate): the go-smtpsrv
+// library's MAIL FROM/RCPT TO processors don't expose the connecting IP or
+// accept extension parameters a client could carry a token in, so a
+// solved challenge can't be bound to a single RCPT TO the way it can for
+// POST /inbox; checking the connecting IP's credit before accepting DATA
+// is the closest equivalent reachable without forking that library.
+//
+// RegisterChallengeRoute/RegisterVerifyRoute (http.go) are the only way a
+// credit gets into an IPGate. Credit is keyed on the IP the HTTP request
+// to /pow/verify arrived from, which is only the same IP that will later
+// connect to the SMTP listener when the two are the same agent - a relay
+// or tool solving its own puzzle before submitting its own mail. Wiring
+// SetProofOfWorkGate up for general third-party inbound mail (a real
+// sender's MTA, which never called /pow/verify and never will) will
+// reject all of it; see SetProofOfWorkGate's doc comment.
+type IPGate struct {
+	issuer *Issuer
+
+	mu      sync.Mutex
+	credits map[string]time.Time
+}
+
+// NewIPGate returns an IPGate that verifies challenges with issuer.
+func NewIPGate(issuer *Issuer) *IPGate {
+	return &IPGate{
+		issuer:  issuer,
+		credits: make(map[string]time.Time),
+	}
+}
+
+// Allow reports whether remoteAddr (a net.Conn.RemoteAddr().String(), e.g.
+// "203.0.113.7:51550") currently holds an unexpired credit.
+func (g *IPGate) Allow(remoteAddr string) bool {
+	ip := hostOf(remoteAddr)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	expiry, ok := g.credits[ip]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expiry) {
+		delete(g.credits, ip)
+		return false
+	}
+
+	return true
+}
+
+// Credit verifies token/nonce against g's Issuer and, if they solve it,
+// credits remoteAddr's IP for ttl.
+func (g *IPGate) Credit(remoteAddr, token string, nonce []byte, ttl time.Duration) error {
+	if err := g.issuer.Verify(token, nonce); err != nil {
+		return err
+	}
+
+	ip := hostOf(remoteAddr)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.credits[ip] = time.Now().Add(ttl)
+
+	return nil
+}
+
+func hostOf(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,229 @@
+// Package pow issues and verifies Hashcash-style proof-of-work challenges,
+// used to gate new-inbox creation and, through IPGate, SMTP DATA acceptance,
+// so a drive-by spammer pays CPU time per inbox and per credited sending IP
+// (one solve covers that IP for creditTTL), while a legitimate browser flow
+// solving a challenge in a WebWorker still finishes in well under a second.
+//
+// A Challenge's token is seed|difficulty|expiry signed with the same
+// bwmarrin/go-alone key used elsewhere to sign inbox tokens (see
+// imapsrv.inboxPassword and notify.WebhookNotifier), so the server never
+// needs to persist outstanding challenges: Verify re-derives everything
+// it needs from the token itself and only has to remember which ones have
+// already been spent.
+package pow
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/go-alone"
+)
+
+// DefaultDifficulty is the number of leading zero bits a solution's hash
+// must have when an Issuer isn't given an explicit starting difficulty.
+const DefaultDifficulty = 20
+
+// DefaultExpiry is how long a client has to solve a challenge before Verify
+// starts rejecting it as expired.
+const DefaultExpiry = 2 * time.Minute
+
+const seedLen = 16
+
+// Challenge is an outstanding proof-of-work puzzle handed to a client.
+// Token is opaque to the client: it's everything the server needs to
+// re-check Difficulty and Expiry without a lookup, and is what the client
+// must echo back alongside the Nonce it found.
+type Challenge struct {
+	Token      string
+	Difficulty uint8
+	Expiry     time.Time
+}
+
+// ErrExpired is returned by Verify when the token's expiry has passed.
+var ErrExpired = fmt.Errorf("pow: challenge expired")
+
+// ErrInsufficientWork is returned by Verify when nonce doesn't drive the
+// token's hash below the required difficulty.
+var ErrInsufficientWork = fmt.Errorf("pow: solution does not meet required difficulty")
+
+// ErrAlreadyConsumed is returned by Verify when token has already been
+// successfully redeemed once.
+var ErrAlreadyConsumed = fmt.Errorf("pow: token already consumed")
+
+// Issuer mints and verifies Challenges, auto-tuning the difficulty it
+// hands out next based on the rolling rate of solutions it accepts.
+//
+// Consumed tokens are tracked in an in-memory set bounded by Expiry, which
+// is sufficient for a single node; a multi-node deployment should instead
+// back Verify's consumed-check with a shared store (e.g. the same
+// burner.Database each node already talks to) keyed on the token.
+type Issuer struct {
+	signer *goalone.Sword
+
+	mu         sync.Mutex
+	difficulty uint8
+	window     []bool // recent Verify outcomes, true = accepted
+
+	consumed *consumedSet
+}
+
+// NewIssuer returns an Issuer signing challenges with signer and starting
+// at DefaultDifficulty.
+func NewIssuer(signer *goalone.Sword) *Issuer {
+	return &Issuer{
+		signer:     signer,
+		difficulty: DefaultDifficulty,
+		consumed:   newConsumedSet(),
+	}
+}
+
+// Issue mints a new Challenge at the Issuer's current difficulty, expiring
+// after DefaultExpiry.
+func (iss *Issuer) Issue() (Challenge, error) {
+	seed := make([]byte, seedLen)
+	if _, err := rand.Read(seed); err != nil {
+		return Challenge{}, fmt.Errorf("pow.Issuer.Issue: failed to read random seed: %w", err)
+	}
+
+	iss.mu.Lock()
+	difficulty := iss.difficulty
+	iss.mu.Unlock()
+
+	expiry := time.Now().Add(DefaultExpiry)
+
+	payload := encodePayload(seed, difficulty, expiry)
+	token := fmt.Sprintf("%s", iss.signer.Sign(payload))
+
+	return Challenge{
+		Token:      token,
+		Difficulty: difficulty,
+		Expiry:     expiry,
+	}, nil
+}
+
+// Verify checks that nonce solves token: the signature is valid, the
+// challenge hasn't expired, and sha256(token||nonce) has at least the
+// required number of leading zero bits. A valid solution atomically
+// marks the token consumed (see consumedSet.tryConsume) so it can't be
+// replayed, including by a second Verify call racing this one with the
+// same solved token.
+func (iss *Issuer) Verify(token string, nonce []byte) error {
+	payload, err := iss.signer.Unsign([]byte(token))
+	if err != nil {
+		return fmt.Errorf("pow.Issuer.Verify: invalid token: %w", err)
+	}
+
+	_, difficulty, expiry, err := decodePayload(payload)
+	if err != nil {
+		return fmt.Errorf("pow.Issuer.Verify: malformed token: %w", err)
+	}
+
+	if time.Now().After(expiry) {
+		iss.recordResult(false)
+		return ErrExpired
+	}
+
+	h := sha256.Sum256(append([]byte(token), nonce...))
+	if leadingZeroBits(h[:]) < int(difficulty) {
+		iss.recordResult(false)
+		return ErrInsufficientWork
+	}
+
+	// tryConsume is the only check-and-set on token: doing the
+	// not-yet-consumed check and the mark-consumed write under one lock
+	// acquisition is what stops two concurrent Verify calls racing the
+	// same solved (token, nonce) from both passing a separate "already
+	// consumed?" check before either recorded it, and so both being
+	// credited for a single solve.
+	if !iss.consumed.tryConsume(token, expiry) {
+		iss.recordResult(false)
+		return ErrAlreadyConsumed
+	}
+
+	iss.recordResult(true)
+
+	return nil
+}
+
+// recordResult folds accepted into the Issuer's rolling acceptance-rate
+// window and re-tunes difficulty: a high acceptance rate means the puzzle
+// is too cheap for how much traffic is getting through, so difficulty
+// steps up; a low one means legitimate clients are likely struggling or
+// timing out, so it steps back down. difficulty is kept within
+// [DefaultDifficulty-4, DefaultDifficulty+8] so auto-tuning can't runaway
+// in either direction.
+func (iss *Issuer) recordResult(accepted bool) {
+	const windowSize = 200
+	const highWatermark = 0.9
+	const lowWatermark = 0.5
+
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+
+	iss.window = append(iss.window, accepted)
+	if len(iss.window) > windowSize {
+		iss.window = iss.window[len(iss.window)-windowSize:]
+	}
+
+	if len(iss.window) < windowSize {
+		return
+	}
+
+	var accepts int
+	for _, ok := range iss.window {
+		if ok {
+			accepts++
+		}
+	}
+	rate := float64(accepts) / float64(len(iss.window))
+
+	switch {
+	case rate > highWatermark && iss.difficulty < DefaultDifficulty+8:
+		iss.difficulty++
+		iss.window = iss.window[:0]
+	case rate < lowWatermark && iss.difficulty > DefaultDifficulty-4:
+		iss.difficulty--
+		iss.window = iss.window[:0]
+	}
+}
+
+func encodePayload(seed []byte, difficulty uint8, expiry time.Time) []byte {
+	payload := make([]byte, seedLen+1+8)
+	copy(payload, seed)
+	payload[seedLen] = difficulty
+	binary.BigEndian.PutUint64(payload[seedLen+1:], uint64(expiry.Unix()))
+	return payload
+}
+
+func decodePayload(payload []byte) (seed []byte, difficulty uint8, expiry time.Time, err error) {
+	if len(payload) != seedLen+1+8 {
+		return nil, 0, time.Time{}, fmt.Errorf("decodePayload: unexpected payload length %d", len(payload))
+	}
+
+	seed = payload[:seedLen]
+	difficulty = payload[seedLen]
+	expiry = time.Unix(int64(binary.BigEndian.Uint64(payload[seedLen+1:])), 0)
+
+	return seed, difficulty, expiry, nil
+}
+
+// leadingZeroBits returns the number of leading zero bits in bb.
+func leadingZeroBits(bb []byte) int {
+	var n int
+	for _, b := range bb {
+		if b == 0 {
+			n += 8
+			continue
+		}
+
+		for mask := byte(0x80); mask > 0 && b&mask == 0; mask >>= 1 {
+			n++
+		}
+		break
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package pow
+
+import (
+	"crypto/sha256"
+	"sync"
+	"testing"
+
+	goalone "github.com/bwmarrin/go-alone"
+)
+
+// solve brute-forces a nonce satisfying ch's difficulty; difficulty 1 keeps
+// this fast enough to run on every test invocation.
+func solve(t *testing.T, ch Challenge) []byte {
+	t.Helper()
+
+	for i := 0; ; i++ {
+		nonce := []byte{byte(i), byte(i >> 8), byte(i >> 16), byte(i >> 24)}
+		h := sha256.Sum256(append([]byte(ch.Token), nonce...))
+		if leadingZeroBits(h[:]) >= int(ch.Difficulty) {
+			return nonce
+		}
+	}
+}
+
+func newTestIssuer() *Issuer {
+	iss := NewIssuer(goalone.New([]byte("test-signing-key")))
+	iss.difficulty = 1
+	return iss
+}
+
+func TestVerifyConcurrentReplayOnlyCreditsOnce(t *testing.T) {
+	iss := newTestIssuer()
+
+	ch, err := iss.Issue()
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	nonce := solve(t, ch)
+
+	const callers = 20
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var successes int
+
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			if err := iss.Verify(ch.Token, nonce); err == nil {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if successes != 1 {
+		t.Errorf("got %d successful concurrent Verify calls for the same solved token, want exactly 1", successes)
+	}
+}
+
+func TestVerifyRejectsReplayAfterSuccess(t *testing.T) {
+	iss := newTestIssuer()
+
+	ch, err := iss.Issue()
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	nonce := solve(t, ch)
+
+	if err := iss.Verify(ch.Token, nonce); err != nil {
+		t.Fatalf("first Verify failed: %v", err)
+	}
+
+	if err := iss.Verify(ch.Token, nonce); err != ErrAlreadyConsumed {
+		t.Errorf("second Verify returned %v, want ErrAlreadyConsumed", err)
+	}
+}
@@ -0,0 +1,184 @@
+package smtpmail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email"
+	log "github.com/sirupsen/logrus"
+)
+
+// extractParts walks a (possibly nested) multipart/mixed, multipart/related
+// or multipart/alternative tree, decoding each leaf part's
+// Content-Transfer-Encoding, and returns the first plain text and HTML
+// bodies found plus every other leaf part as an attachment.
+func extractParts(r io.Reader, boundary string) (text, html string, attachments []burner.Attachment, err error) {
+	mr := multipart.NewReader(r, boundary)
+
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return text, html, attachments, nil
+		} else if err != nil {
+			return "", "", nil, fmt.Errorf("smtp.extractParts: failed to get next part: %w", err)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if err != nil {
+			mediaType = "text/plain"
+		}
+
+		if strings.HasPrefix(mediaType, "multipart/") {
+			nestedText, nestedHTML, nestedAttachments, err := extractParts(p, params["boundary"])
+			if err != nil {
+				return "", "", nil, fmt.Errorf("smtp.extractParts: failed to parse nested %s: %w", mediaType, err)
+			}
+
+			if nestedText != "" && text == "" {
+				text = nestedText
+			}
+			if nestedHTML != "" && html == "" {
+				html = nestedHTML
+			}
+			attachments = append(attachments, nestedAttachments...)
+			continue
+		}
+
+		bb, err := decodeBody(p, p.Header.Get("Content-Transfer-Encoding"), params["charset"])
+		if err != nil {
+			return "", "", nil, fmt.Errorf("smtp.extractParts: failed to decode part: %w", err)
+		}
+
+		disposition, dispParams, _ := mime.ParseMediaType(p.Header.Get("Content-Disposition"))
+
+		switch {
+		case mediaType == "text/plain" && disposition != "attachment" && text == "":
+			text = string(bytes.TrimSpace(bb))
+		case mediaType == "text/html" && disposition != "attachment" && html == "":
+			modifiedHTML, err := email.AddTargetBlank(string(bytes.TrimSpace(bb)))
+			if err != nil {
+				return "", "", nil, fmt.Errorf("smtp.extractParts: failed to AddTargetBlank: %w", err)
+			}
+			html = modifiedHTML
+		default:
+			att, err := newAttachment(p, mediaType, params, disposition, dispParams, bb)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("smtp.extractParts: failed to build attachment: %w", err)
+			}
+			attachments = append(attachments, att)
+		}
+	}
+}
+
+func newAttachment(p *multipart.Part, mediaType string, params map[string]string, disposition string, dispParams map[string]string, data []byte) (burner.Attachment, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return burner.Attachment{}, fmt.Errorf("newAttachment: failed to generate id: %w", err)
+	}
+
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	return burner.Attachment{
+		ID:          id.String(),
+		Filename:    filename,
+		ContentType: mediaType,
+		Size:        int64(len(data)),
+		ContentID:   strings.Trim(p.Header.Get("Content-Id"), "<>"),
+		Disposition: disposition,
+		Data:        data,
+	}, nil
+}
+
+var cidRefPattern = regexp.MustCompile(`cid:([^"'\s)]+)`)
+
+// rewriteCIDRefs rewrites "cid:" references in html (e.g. an inline image's
+// <img src="cid:...">) to point at this message's attachment route, since
+// mail clients viewing messages through the web UI can't resolve
+// Content-ID references the way a native mail client would.
+func rewriteCIDRefs(html, inboxID, msgID string, attachments []burner.Attachment) string {
+	if html == "" || len(attachments) == 0 {
+		return html
+	}
+
+	return cidRefPattern.ReplaceAllStringFunc(html, func(match string) string {
+		contentID := strings.TrimPrefix(match, "cid:")
+
+		for _, a := range attachments {
+			if a.ContentID == contentID {
+				return fmt.Sprintf("/inbox/%s/messages/%s/att/%s", inboxID, msgID, a.ID)
+			}
+		}
+
+		return match
+	})
+}
+
+// isActiveContentType reports whether contentType is one attachmentHandler
+// never honours a sender's Content-Disposition for. These types - text/html,
+// text/xml, application/xml and any +xml or svg type, all of which can carry
+// script - are forced to Content-Disposition: attachment regardless of
+// what the part's own headers said, since those headers are entirely
+// attacker-controlled and would otherwise be served back inline from this
+// app's own origin: a classic stored-XSS-via-attachment.
+func isActiveContentType(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return contentType == "text/html" ||
+		contentType == "text/xml" ||
+		contentType == "application/xml" ||
+		contentType == "image/svg+xml" ||
+		strings.HasSuffix(contentType, "+xml")
+}
+
+// RegisterAttachmentRoute mounts /inbox/{id}/messages/{mid}/att/{aid} on r,
+// which streams a single stored attachment back with the Content-Type and
+// Content-Disposition it arrived with, except that a part with no
+// disposition or with an active content type (see isActiveContentType) is
+// always served as attachment.
+func (s *SMTPMail) RegisterAttachmentRoute(r *mux.Router, db burner.Database) {
+	r.HandleFunc("/inbox/{id}/messages/{mid}/att/{aid}", attachmentHandler(db)).Methods("GET")
+}
+
+func attachmentHandler(db burner.Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		inboxID, mID, aID := vars["id"], vars["mid"], vars["aid"]
+
+		msg, err := db.GetMessageByID(inboxID, mID)
+		if err != nil {
+			log.WithError(err).Error("smtpmail.attachmentHandler: failed to get message")
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+
+		for _, a := range msg.Attachments {
+			if a.ID != aID {
+				continue
+			}
+
+			disposition := a.Disposition
+			if disposition == "" || isActiveContentType(a.ContentType) {
+				disposition = "attachment"
+			}
+
+			w.Header().Set("Content-Type", a.ContentType)
+			w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, a.Filename))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.Write(a.Data)
+			return
+		}
+
+		http.Error(w, "attachment not found", http.StatusNotFound)
+	}
+}
@@ -0,0 +1,226 @@
+package smtpmail
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	smtpsrv "github.com/alash3al/go-smtpsrv"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	"github.com/haydenwoodhead/burner.kiwi/email/dkim"
+	"github.com/haydenwoodhead/burner.kiwi/email/dmarc"
+	"github.com/zaccone/spf"
+)
+
+// AuthAction is what to do with a message that fails one of SPF, DKIM or
+// DMARC.
+type AuthAction string
+
+const (
+	// AuthActionTag stores the message as normal; only the computed
+	// results and Authentication-Results header are attached, for the web
+	// UI to show a badge on.
+	AuthActionTag AuthAction = "tag"
+	// AuthActionQuarantine stores the message but marks it Hidden, so it's
+	// excluded from the default inbox listing.
+	AuthActionQuarantine AuthAction = "quarantine"
+	// AuthActionReject refuses the message outright; the SMTP client gets
+	// a temporary failure and nothing is saved.
+	AuthActionReject AuthAction = "reject"
+)
+
+// AuthPolicy configures what action a failing SPF, DKIM or DMARC check
+// should trigger. Any field left empty defaults to AuthActionTag, i.e.
+// verify and record the result without changing delivery.
+type AuthPolicy struct {
+	SPF   AuthAction
+	DKIM  AuthAction
+	DMARC AuthAction
+}
+
+func (p AuthPolicy) withDefaults() AuthPolicy {
+	if p.SPF == "" {
+		p.SPF = AuthActionTag
+	}
+	if p.DKIM == "" {
+		p.DKIM = AuthActionTag
+	}
+	if p.DMARC == "" {
+		p.DMARC = AuthActionTag
+	}
+	return p
+}
+
+// authOutcome is the result of running SPF/DKIM/DMARC against a message,
+// folded down to the single most severe action any of the three checks
+// triggered under the handler's AuthPolicy.
+type authOutcome struct {
+	spfResult   string
+	dkimResults []burner.DKIMResult
+	dmarcResult string
+	header      string
+	action      AuthAction
+}
+
+// evaluateAuth runs SPF (already computed by go-smtpsrv against req.From
+// and the connecting IP at MAIL FROM time), DKIM and DMARC against a
+// complete RFC822 message reconstructed from req.Message's headers and
+// bodyBytes, and folds the three results down to a single AuthAction plus
+// a synthesized Authentication-Results header to persist alongside the
+// message.
+//
+// The message DKIM/DMARC verify is reconstructed rather than being the
+// original bytes on the wire, because go-smtpsrv's DATA processor parses
+// the message via net/mail before handing it to Handler and doesn't
+// retain the original bytes. net/mail also re-cases header field names to
+// its own canonical form (e.g. "Dkim-Signature"), so c=simple-
+// canonicalized DKIM signatures may fail to verify even when valid;
+// c=relaxed, used by the large majority of senders, is unaffected since
+// it lowercases names anyway.
+func evaluateAuth(req *smtpsrv.Request, bodyBytes []byte, policy AuthPolicy) authOutcome {
+	policy = policy.withDefaults()
+
+	raw := reconstructRaw(req.Message.Header, bodyBytes)
+
+	spfResult := req.SPFResult.String()
+	spfPass := req.SPFResult == spf.Pass
+
+	dkimVerifications := dkim.Verify(raw)
+
+	var dkimResults []burner.DKIMResult
+	var dkimPassDomains []string
+	for _, v := range dkimVerifications {
+		r := burner.DKIMResult{
+			Domain:   v.Domain,
+			Selector: v.Selector,
+			Pass:     v.Err == nil,
+		}
+		if v.Err != nil {
+			r.Err = v.Err.Error()
+		} else {
+			dkimPassDomains = append(dkimPassDomains, v.Domain)
+		}
+		dkimResults = append(dkimResults, r)
+	}
+
+	fromDomain := addrDomain(req.Message.Header.Get("From"))
+	_, spfEnvelopeDomain := splitAddr(req.From)
+
+	dmarcResult := dmarc.Evaluate(fromDomain, spfPass, spfEnvelopeDomain, dkimPassDomains)
+
+	header := buildAuthResultsHeader(req, spfResult, dkimResults, dmarcResult)
+
+	action := actionForSPF(req.SPFResult, policy.SPF)
+	action = strictest(action, actionFor(dkimResults, policy.DKIM))
+	action = strictest(action, actionForBool(dmarcResult.Aligned, policy.DMARC))
+
+	return authOutcome{
+		spfResult:   spfResult,
+		dkimResults: dkimResults,
+		dmarcResult: string(dmarcResult.Applied),
+		header:      header,
+		action:      action,
+	}
+}
+
+func actionFor(results []burner.DKIMResult, onFail AuthAction) AuthAction {
+	if len(results) == 0 {
+		return AuthActionTag
+	}
+	for _, r := range results {
+		if r.Pass {
+			return AuthActionTag
+		}
+	}
+	return onFail
+}
+
+func actionForBool(pass bool, onFail AuthAction) AuthAction {
+	if pass {
+		return AuthActionTag
+	}
+	return onFail
+}
+
+// actionForSPF applies policy.SPF only when result actively indicates
+// forgery (Fail) or the domain's own record couldn't be evaluated
+// (Permerror) - not for SoftFail, Neutral, None or Temperror. None in
+// particular just means the domain doesn't publish SPF at all, which is
+// still extremely common among legitimate senders; treating it the same
+// as Fail would reject/quarantine a large fraction of otherwise-fine mail
+// under a policy meant to catch forged senders.
+func actionForSPF(result spf.Result, onFail AuthAction) AuthAction {
+	if result == spf.Fail || result == spf.Permerror {
+		return onFail
+	}
+	return AuthActionTag
+}
+
+// strictest returns whichever of a, b carries the larger blast radius:
+// reject beats quarantine beats tag.
+func strictest(a, b AuthAction) AuthAction {
+	rank := map[AuthAction]int{AuthActionTag: 0, AuthActionQuarantine: 1, AuthActionReject: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+func buildAuthResultsHeader(req *smtpsrv.Request, spfResult string, dkimResults []burner.DKIMResult, dmarcResult dmarc.Result) string {
+	var parts []string
+
+	parts = append(parts, fmt.Sprintf("spf=%s smtp.mailfrom=%s", spfResult, req.From))
+
+	for _, r := range dkimResults {
+		if r.Pass {
+			parts = append(parts, fmt.Sprintf("dkim=pass header.d=%s header.s=%s", r.Domain, r.Selector))
+		} else {
+			parts = append(parts, fmt.Sprintf("dkim=fail header.d=%s header.s=%s", r.Domain, r.Selector))
+		}
+	}
+
+	dmarcStatus := "pass"
+	if !dmarcResult.Aligned {
+		dmarcStatus = "fail"
+	}
+	parts = append(parts, fmt.Sprintf("dmarc=%s header.from=%s", dmarcStatus, dmarcResult.Domain))
+
+	return fmt.Sprintf("%s; %s", req.Server.Name, strings.Join(parts, ";\r\n\t"))
+}
+
+func addrDomain(headerValue string) string {
+	addr, err := mail.ParseAddress(headerValue)
+	if err != nil {
+		_, domain := splitAddr(headerValue)
+		return domain
+	}
+	_, domain := splitAddr(addr.Address)
+	return domain
+}
+
+func splitAddr(addr string) (local, domain string) {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return addr, ""
+	}
+	return addr[:i], addr[i+1:]
+}
+
+// reconstructRaw rebuilds a minimal RFC822 message (headers, a blank
+// line, then body) from header and body, for DKIM/DMARC verification to
+// run against. See evaluateAuth's doc comment for why this can't be the
+// message's exact original bytes.
+func reconstructRaw(header mail.Header, body []byte) []byte {
+	var buf bytes.Buffer
+
+	for name, values := range header {
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s: %s\r\n", name, v)
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Bytes()
+}
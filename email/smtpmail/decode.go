@@ -0,0 +1,65 @@
+package smtpmail
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/quotedprintable"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// decodeBody reverses a part's Content-Transfer-Encoding and transcodes it
+// from charsetLabel to UTF-8, returning the resulting bytes. cte and
+// charsetLabel are read straight off the part's Content-Transfer-Encoding
+// header and the Content-Type "charset" parameter respectively; either may
+// be empty.
+func decodeBody(r io.Reader, cte, charsetLabel string) ([]byte, error) {
+	bb, err := ioutil.ReadAll(transferDecoder(r, cte))
+	if err != nil {
+		return nil, fmt.Errorf("decodeBody: failed to read body: %w", err)
+	}
+
+	return decodeCharset(bb, charsetLabel)
+}
+
+// transferDecoder wraps r to reverse the given Content-Transfer-Encoding,
+// passing bytes through unchanged for anything other than base64 or
+// quoted-printable (7bit, 8bit, binary, and the absent case all mean "no
+// encoding was applied").
+func transferDecoder(r io.Reader, cte string) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(cte)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// decodeCharset transcodes bb from charsetLabel to UTF-8 using the WHATWG
+// encoding table golang.org/x/net/html/charset resolves labels against.
+// Unknown labels and the UTF-8/US-ASCII cases are left untouched, which
+// also makes this a no-op for binary attachment parts that carry no
+// charset parameter at all.
+func decodeCharset(bb []byte, charsetLabel string) ([]byte, error) {
+	label := strings.ToLower(strings.TrimSpace(charsetLabel))
+	if label == "" || label == "utf-8" || label == "us-ascii" || label == "ascii" {
+		return bb, nil
+	}
+
+	enc, _ := charset.Lookup(label)
+	if enc == nil {
+		return bb, nil
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(bb)
+	if err != nil {
+		return nil, fmt.Errorf("decodeCharset: failed to transcode from %s: %w", charsetLabel, err)
+	}
+
+	return decoded, nil
+}
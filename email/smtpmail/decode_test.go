@@ -0,0 +1,100 @@
+package smtpmail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html/charset"
+)
+
+// encodeForTest round-trips want through the same charset.Lookup encoding
+// decodeCharset itself decodes with, so the fixture bytes are exactly
+// what a sender's MTA would have put on the wire for that label.
+func encodeForTest(t *testing.T, label, want string) []byte {
+	t.Helper()
+
+	enc, name := charset.Lookup(label)
+	if enc == nil {
+		t.Fatalf("encodeForTest: charset.Lookup(%q) returned no encoding", label)
+	}
+
+	got, err := enc.NewEncoder().Bytes([]byte(want))
+	if err != nil {
+		t.Fatalf("encodeForTest: failed to encode fixture as %s: %v", name, err)
+	}
+
+	return got
+}
+
+func TestDecodeCharset(t *testing.T) {
+	tests := []struct {
+		name  string
+		label string
+		want  string
+	}{
+		{"gb2312", "gb2312", "你好，世界"},
+		{"iso-8859-1", "iso-8859-1", "Bonjour tout le monde"},
+		{"shift_jis", "shift_jis", "こんにちは世界"},
+		{"utf-8 passthrough", "utf-8", "héllo wörld"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixture := encodeForTest(t, tt.label, tt.want)
+
+			got, err := decodeCharset(fixture, tt.label)
+			if err != nil {
+				t.Fatalf("decodeCharset(%q) returned error: %v", tt.label, err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("decodeCharset(%q) = %q, want %q", tt.label, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeCharsetEmptyLabelPassthrough(t *testing.T) {
+	const want = "hello world"
+
+	got, err := decodeCharset([]byte(want), "")
+	if err != nil {
+		t.Fatalf("decodeCharset returned error: %v", err)
+	}
+
+	if string(got) != want {
+		t.Errorf("decodeCharset(\"\") = %q, want %q", got, want)
+	}
+}
+
+func TestDecodeBodyQuotedPrintableHTML(t *testing.T) {
+	// A captured-style HTML body as it might arrive quoted-printable
+	// encoded: a soft line break ("=\r\n") splitting a word, and "=E9" for
+	// an accented "é".
+	const qp = "<p>Caf=\r\n=E9 au lait</p>"
+	const want = "<p>Café au lait</p>"
+
+	got, err := decodeBody(strings.NewReader(qp), "quoted-printable", "iso-8859-1")
+	if err != nil {
+		t.Fatalf("decodeBody returned error: %v", err)
+	}
+
+	if string(got) != want {
+		t.Errorf("decodeBody(quoted-printable, iso-8859-1) = %q, want %q", got, want)
+	}
+}
+
+func TestTransferDecoderBase64(t *testing.T) {
+	const want = "hello world"
+	fixture := bytes.NewReader([]byte("aGVsbG8gd29ybGQ="))
+
+	got, err := decodeBody(fixture, "base64", "")
+	if err != nil {
+		t.Fatalf("decodeBody returned error: %v", err)
+	}
+
+	if string(got) != want {
+		t.Errorf("decodeBody(base64) = %q, want %q", got, want)
+	}
+}
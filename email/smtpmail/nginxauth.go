@@ -0,0 +1,79 @@
+package smtpmail
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// RegisterAuthRoute mounts /smtp-auth on r, implementing nginx's mail proxy
+// auth_http protocol (http://nginx.org/en/docs/mail/ngx_mail_auth_http_module.html).
+// Pointing nginx's smtp_auth_http directive at this route lets operators
+// put nginx's TLS/PROXY-protocol handling in front of paltamail's SMTP
+// ingest and scale it horizontally, while recipient policy
+// (isBlacklisted / EmailAddressExists) stays here. Accepted recipients are
+// told to connect to s's own listener, which does the actual ingest.
+func (s *SMTPMail) RegisterAuthRoute(r *mux.Router, db burner.Database, isBlacklisted func(string) bool) {
+	r.HandleFunc("/smtp-auth", authHandler(db, isBlacklisted, s.listenAddr)).Methods("GET")
+}
+
+func authHandler(db burner.Database, isBlacklisted func(string) bool, backendAddr string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		log.WithFields(log.Fields{
+			"auth_method":   req.Header.Get("Auth-Method"),
+			"auth_user":     req.Header.Get("Auth-User"),
+			"auth_protocol": req.Header.Get("Auth-Protocol"),
+			"auth_smtp_to":  req.Header.Get("Auth-SMTP-To"),
+		}).Debug("smtpmail.authHandler: handling nginx auth_http request")
+
+		rcpt := req.Header.Get("Auth-SMTP-To")
+		if rcpt == "" {
+			denyAuth(w, "Recipient address rejected: need fully-qualified address", "0")
+			return
+		}
+
+		if isBlacklisted(rcpt) {
+			denyAuth(w, "Recipient address rejected: Address blacklisted", "0")
+			return
+		}
+
+		exists, err := db.EmailAddressExists(rcpt)
+		if err != nil {
+			log.WithError(err).Error("smtpmail.authHandler: failed to query if email exists")
+			denyAuth(w, "Temporary lookup failure", "10")
+			return
+		}
+
+		if !exists {
+			denyAuth(w, "Recipient address rejected: User unknown", "0")
+			return
+		}
+
+		host, port, err := net.SplitHostPort(backendAddr)
+		if err != nil {
+			log.WithError(err).WithField("listen_addr", backendAddr).Error("smtpmail.authHandler: failed to split backend listen address")
+			denyAuth(w, "Internal server error", "10")
+			return
+		}
+		if host == "" {
+			host = "127.0.0.1"
+		}
+
+		w.Header().Set("Auth-Status", "OK")
+		w.Header().Set("Auth-Server", host)
+		w.Header().Set("Auth-Port", port)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// denyAuth tells nginx to reject the SMTP session with status as the SMTP
+// reply text and wait seconds before the client may retry. Per the
+// auth_http protocol, rejects are still reported as HTTP 200.
+func denyAuth(w http.ResponseWriter, status, wait string) {
+	w.Header().Set("Auth-Status", status)
+	w.Header().Set("Auth-Wait", wait)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,333 @@
+package smtpmail
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/haydenwoodhead/burner.kiwi/burner"
+	log "github.com/sirupsen/logrus"
+)
+
+// Attachment is a single file to be attached to an outbound message.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Sender delivers outbound mail on behalf of a burner inbox. It relays
+// through the configured smarthost when one is set; otherwise it looks up
+// the recipient's MX records and delivers directly, which keeps paltamail
+// working on setups that don't want to run a separate relay. A failed
+// smarthost delivery is returned as an error, not retried direct-to-MX.
+type Sender struct {
+	// Smarthost, if set, is used as an "host:port" to relay all outbound
+	// mail through rather than talking to the recipient's MX directly.
+	Smarthost string
+	Username  string
+	Password  string
+	// HELODomain is sent as the EHLO/HELO identity and used to build the
+	// Message-ID of outgoing mail.
+	HELODomain string
+}
+
+// NewSender creates a Sender that relays through smarthost using the given
+// credentials. Leave smarthost empty to always deliver direct-to-MX.
+func NewSender(helloDomain, smarthost, username, password string) *Sender {
+	return &Sender{
+		Smarthost:  smarthost,
+		Username:   username,
+		Password:   password,
+		HELODomain: helloDomain,
+	}
+}
+
+// Send builds a multipart/alternative RFC 5322 message from, to, subject,
+// bodyHTML and bodyPlain (plus any attachments) and delivers it either via
+// the configured smarthost or directly to the recipient's MX servers.
+//
+// inReplyTo and references, if non-empty, are copied onto the In-Reply-To
+// and References headers so mail clients thread the reply under the
+// original message.
+func (s *Sender) Send(from, to, subject, bodyHTML, bodyPlain, inReplyTo, references string, attachments []Attachment) error {
+	msg, err := buildMessage(s.HELODomain, from, to, subject, bodyHTML, bodyPlain, inReplyTo, references, attachments)
+	if err != nil {
+		return fmt.Errorf("sender.Send: failed to build message: %w", err)
+	}
+
+	if s.Smarthost != "" {
+		return s.sendViaSmarthost(from, to, msg)
+	}
+
+	return s.sendDirect(from, to, msg)
+}
+
+func (s *Sender) sendViaSmarthost(from, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(s.Smarthost)
+	if err != nil {
+		return fmt.Errorf("sender.sendViaSmarthost: failed to split smarthost: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	if err := sendWithSTARTTLS(s.Smarthost, host, s.HELODomain, auth, from, []string{to}, msg); err != nil {
+		return fmt.Errorf("sender.sendViaSmarthost: failed to send via %s: %w", s.Smarthost, err)
+	}
+
+	return nil
+}
+
+// sendDirect looks up the MX records for the recipient's domain and
+// attempts delivery to each in preference order, stopping at the first
+// host that accepts the message.
+func (s *Sender) sendDirect(from, to string, msg []byte) error {
+	_, domain, err := splitAddress(to)
+	if err != nil {
+		return fmt.Errorf("sender.sendDirect: %w", err)
+	}
+
+	mxs, err := net.LookupMX(domain)
+	if err != nil || len(mxs) == 0 {
+		return fmt.Errorf("sender.sendDirect: failed to lookup MX records for %s: %w", domain, err)
+	}
+
+	var lastErr error
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		addr := net.JoinHostPort(host, "25")
+
+		err := sendWithSTARTTLS(addr, host, s.HELODomain, nil, from, []string{to}, msg)
+		if err == nil {
+			return nil
+		}
+
+		log.WithError(err).WithField("mx", host).Warn("sender.sendDirect: delivery attempt failed, trying next MX")
+		lastErr = err
+	}
+
+	return fmt.Errorf("sender.sendDirect: all MX delivery attempts to %s failed: %w", domain, lastErr)
+}
+
+// sendWithSTARTTLS connects to addr, upgrades to TLS with STARTTLS when the
+// remote offers it, authenticates with auth if non-nil, and sends msg from
+// "from" to each of "to". It falls back to plaintext delivery if the
+// remote doesn't support STARTTLS, which is common for receiving MX hosts.
+func sendWithSTARTTLS(addr, tlsServerName, helo string, auth smtp.Auth, from string, to []string, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", addr, 30*time.Second)
+	if err != nil {
+		return fmt.Errorf("sendWithSTARTTLS: failed to dial %s: %w", addr, err)
+	}
+	defer conn.Close()
+
+	c, err := smtp.NewClient(conn, tlsServerName)
+	if err != nil {
+		return fmt.Errorf("sendWithSTARTTLS: failed to create smtp client: %w", err)
+	}
+	defer c.Close()
+
+	if helo != "" {
+		if err := c.Hello(helo); err != nil {
+			return fmt.Errorf("sendWithSTARTTLS: HELO failed: %w", err)
+		}
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: tlsServerName}); err != nil {
+			return fmt.Errorf("sendWithSTARTTLS: STARTTLS failed: %w", err)
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(auth); err != nil {
+				return fmt.Errorf("sendWithSTARTTLS: AUTH failed: %w", err)
+			}
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("sendWithSTARTTLS: MAIL FROM failed: %w", err)
+	}
+
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("sendWithSTARTTLS: RCPT TO %s failed: %w", rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("sendWithSTARTTLS: DATA failed: %w", err)
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("sendWithSTARTTLS: failed to write message: %w", err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("sendWithSTARTTLS: failed to close DATA writer: %w", err)
+	}
+
+	return c.Quit()
+}
+
+func splitAddress(address string) (local, domain string, err error) {
+	idx := strings.LastIndex(address, "@")
+	if idx < 0 {
+		return "", "", fmt.Errorf("splitAddress: %q is not a valid email address", address)
+	}
+	return address[:idx], address[idx+1:], nil
+}
+
+// buildMessage assembles a well-formed multipart/alternative RFC 5322
+// message, threading it under inReplyTo/references when they're set.
+func buildMessage(helo, from, to, subject, bodyHTML, bodyPlain, inReplyTo, references string, attachments []Attachment) ([]byte, error) {
+	mID, err := uuid.NewRandom()
+	if err != nil {
+		return nil, fmt.Errorf("buildMessage: failed to generate message id: %w", err)
+	}
+
+	host := helo
+	if host == "" {
+		host = "localhost"
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	plainPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, fmt.Errorf("buildMessage: failed to create plain part: %w", err)
+	}
+	if _, err := plainPart.Write([]byte(bodyPlain)); err != nil {
+		return nil, fmt.Errorf("buildMessage: failed to write plain part: %w", err)
+	}
+
+	htmlPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+	if err != nil {
+		return nil, fmt.Errorf("buildMessage: failed to create html part: %w", err)
+	}
+	if _, err := htmlPart.Write([]byte(bodyHTML)); err != nil {
+		return nil, fmt.Errorf("buildMessage: failed to write html part: %w", err)
+	}
+
+	for _, a := range attachments {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {a.ContentType},
+			"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", a.Filename)},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("buildMessage: failed to create attachment part for %s: %w", a.Filename, err)
+		}
+		if _, err := part.Write(a.Data); err != nil {
+			return nil, fmt.Errorf("buildMessage: failed to write attachment %s: %w", a.Filename, err)
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, fmt.Errorf("buildMessage: failed to close multipart writer: %w", err)
+	}
+
+	var out bytes.Buffer
+	headers := textproto.MIMEHeader{}
+	headers.Set("From", from)
+	headers.Set("To", to)
+	headers.Set("Subject", mime.QEncoding.Encode("UTF-8", subject))
+	headers.Set("Date", time.Now().UTC().Format(time.RFC1123Z))
+	headers.Set("Message-ID", fmt.Sprintf("<%s@%s>", mID.String(), host))
+	headers.Set("MIME-Version", "1.0")
+	headers.Set("Content-Type", fmt.Sprintf("multipart/alternative; boundary=%s", mw.Boundary()))
+
+	if inReplyTo != "" {
+		headers.Set("In-Reply-To", inReplyTo)
+	}
+	if references != "" {
+		headers.Set("References", references)
+	}
+
+	for k, vs := range headers {
+		for _, v := range vs {
+			fmt.Fprintf(&out, "%s: %s\r\n", k, v)
+		}
+	}
+	out.WriteString("\r\n")
+	out.Write(body.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// RegisterReplyRoute mounts a handler on r at
+// /inbox/{id}/messages/{mid}/reply that lets a burner address reply to the
+// sender of a received message, threading the reply under it via
+// In-Reply-To/References taken from the stored message.
+func (s *SMTPMail) RegisterReplyRoute(r *mux.Router, db burner.Database, sender *Sender) {
+	r.HandleFunc("/inbox/{id}/messages/{mid}/reply", replyHandler(db, sender)).Methods("POST")
+}
+
+func replyHandler(db burner.Database, sender *Sender) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		vars := mux.Vars(req)
+		inboxID, mID := vars["id"], vars["mid"]
+
+		inbox, err := db.GetInboxByID(inboxID)
+		if err != nil {
+			log.WithError(err).Error("smtpmail.replyHandler: failed to get inbox")
+			http.Error(w, "inbox not found", http.StatusNotFound)
+			return
+		}
+
+		msg, err := db.GetMessageByID(inboxID, mID)
+		if err != nil {
+			log.WithError(err).Error("smtpmail.replyHandler: failed to get message")
+			http.Error(w, "message not found", http.StatusNotFound)
+			return
+		}
+
+		if err := req.ParseForm(); err != nil {
+			http.Error(w, "bad form", http.StatusBadRequest)
+			return
+		}
+
+		subject := req.FormValue("subject")
+		if subject == "" {
+			subject = "Re: " + msg.Subject
+		}
+
+		references := msg.MessageID
+		if msg.References != "" {
+			references = msg.References + " " + msg.MessageID
+		}
+
+		err = sender.Send(
+			inbox.Address,
+			msg.Sender,
+			subject,
+			req.FormValue("body_html"),
+			req.FormValue("body_plain"),
+			msg.MessageID,
+			references,
+			nil,
+		)
+		if err != nil {
+			log.WithError(err).Error("smtpmail.replyHandler: failed to send reply")
+			http.Error(w, "failed to send reply", http.StatusBadGateway)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
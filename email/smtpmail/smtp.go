@@ -4,10 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"mime"
-	"mime/multipart"
 	"net"
 	"strings"
 	"time"
@@ -17,6 +15,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/haydenwoodhead/burner.kiwi/burner"
 	"github.com/haydenwoodhead/burner.kiwi/email"
+	"github.com/haydenwoodhead/burner.kiwi/email/pow"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
@@ -27,11 +26,56 @@ type SMTPMail struct {
 	srv        *smtpsrv.Server
 	listenAddr string
 	listener   *net.Listener
+
+	// onNewMessage and buildRFC822, if set via SetNewMessageHook, are
+	// handed to the handler in Start. imapsrv wires these up so it can
+	// cache a synthetic RFC822 blob per message and wake up clients
+	// IDLE-ing on the owning inbox, without smtpmail importing imapsrv.
+	onNewMessage func(inboxID string)
+	buildRFC822  func(burner.Message) []byte
+
+	// notify, if set via SetNotifyHook, is handed to the handler in Start.
+	// notify.Dispatch wires this up so it can fan a message out to
+	// whatever notification channels the owning inbox was configured
+	// with, without smtpmail importing notify.
+	notify func(inbox burner.Inbox, msg burner.Message)
+
+	// powGate, if set via SetProofOfWorkGate, is handed to the handler in
+	// Start. A sending IP must hold a credit on it (won by solving a
+	// pow.Challenge through the web UI's PoW endpoint) before a message
+	// from that IP is accepted, so a drive-by spammer pays CPU for a solve
+	// before its mail is accepted; one solve credits the IP for a limited
+	// time (see pow.IPGate), not for a single message.
+	powGate *pow.IPGate
+
+	// authPolicy, set via SetAuthPolicy, is handed to the handler in
+	// Start. It decides what happens to a message that fails SPF, DKIM or
+	// DMARC: tag it and save as normal, quarantine it, or reject it
+	// outright.
+	authPolicy AuthPolicy
 }
 
 type handler struct {
 	db            burner.Database
 	isBlacklisted func(string) bool
+	// onNewMessage, if set, is called with the owning inbox ID after a
+	// message has been saved. imapsrv uses this to wake up any client
+	// IDLE-ing on that inbox.
+	onNewMessage func(inboxID string)
+	// buildRFC822, if set, builds the synthetic RFC822 blob cached on the
+	// message so imapsrv can later serve FETCH BODY[]/BODYSTRUCTURE/
+	// RFC822.SIZE without re-deriving them from the parsed fields.
+	buildRFC822 func(burner.Message) []byte
+	// notify, if set, is called with the owning inbox and the saved
+	// message so any configured notification channel (webhook, Telegram,
+	// chat-op bot) can fire.
+	notify func(inbox burner.Inbox, msg burner.Message)
+	// powGate, if set, gates DATA acceptance on the sending IP holding a
+	// solved proof-of-work credit.
+	powGate *pow.IPGate
+	// authPolicy decides what to do with a message that fails SPF, DKIM
+	// or DMARC.
+	authPolicy AuthPolicy
 }
 
 func NewSMPTMailProvider(listenAddr string) *SMTPMail {
@@ -41,10 +85,56 @@ func NewSMPTMailProvider(listenAddr string) *SMTPMail {
 	}
 }
 
+// SetNewMessageHook wires onNewMessage and buildRFC822 into every message
+// the handler saves from here on. Call it before Start. imapsrv passes its
+// Server.NotifyNewMessage and BuildRFC822 here so it can back IDLE and
+// FETCH BODY[] without smtpmail depending on it directly.
+func (s *SMTPMail) SetNewMessageHook(onNewMessage func(inboxID string), buildRFC822 func(burner.Message) []byte) {
+	s.onNewMessage = onNewMessage
+	s.buildRFC822 = buildRFC822
+}
+
+// SetNotifyHook wires notify into every message the handler saves from
+// here on. Call it before Start. notify.Dispatch builds this from the
+// inbox's configured notify_* fields and the signer/website address
+// needed to build a signed link back into the web UI.
+func (s *SMTPMail) SetNotifyHook(notify func(inbox burner.Inbox, msg burner.Message)) {
+	s.notify = notify
+}
+
+// SetProofOfWorkGate requires every message accepted from here on to come
+// from an IP holding a credit on gate, i.e. one that has recently solved a
+// pow.Challenge via gate's /pow/challenge and /pow/verify routes. Call it
+// before Start. Leaving it unset (the default) accepts mail from anyone,
+// same as before proof-of-work gating existed.
+//
+// Only turn this on for a deployment that itself controls what's allowed
+// to connect to the SMTP listener (e.g. a relay that solves its own
+// challenge before submitting its own mail): a credit is earned by
+// whatever IP called /pow/verify, which is unrelated to the IP of a real
+// third-party sender's mail server relaying someone else's mail. For
+// ordinary open inbound mail, wiring this up rejects every message, not
+// just drive-by spam - see pow.IPGate's doc comment.
+func (s *SMTPMail) SetProofOfWorkGate(gate *pow.IPGate) {
+	s.powGate = gate
+}
+
+// SetAuthPolicy configures what happens to a message that fails SPF,
+// DKIM or DMARC. Call it before Start. The zero value tags every message
+// with its verification results but never blocks or hides anything.
+func (s *SMTPMail) SetAuthPolicy(policy AuthPolicy) {
+	s.authPolicy = policy
+}
+
 func (s *SMTPMail) Start(websiteAddr string, db burner.Database, r *mux.Router, isBlacklisted func(string) bool) error {
 	h := &handler{
 		db:            db,
 		isBlacklisted: isBlacklisted,
+		onNewMessage:  s.onNewMessage,
+		buildRFC822:   s.buildRFC822,
+		notify:        s.notify,
+		powGate:       s.powGate,
+		authPolicy:    s.authPolicy,
 	}
 
 	s.srv = &smtpsrv.Server{
@@ -73,6 +163,22 @@ func (s *SMTPMail) Start(websiteAddr string, db burner.Database, r *mux.Router,
 }
 
 func (h *handler) handler(req *smtpsrv.Request) error {
+	if h.powGate != nil && !h.powGate.Allow(req.RemoteAddr) {
+		return fmt.Errorf("smtp.handler: %s has no proof-of-work credit", req.RemoteAddr)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(req.Message.Body)
+	if err != nil {
+		log.WithError(err).Error("smtpmail.handler: failed to buffer body for auth checks")
+		return fmt.Errorf("smtp.handler: failed to buffer body for auth checks: %w", err)
+	}
+	req.Message.Body = bytes.NewReader(bodyBytes)
+
+	auth := evaluateAuth(req, bodyBytes, h.authPolicy)
+	if auth.action == AuthActionReject {
+		return fmt.Errorf("smtp.handler: message rejected by auth policy (spf=%s dmarc=%s)", auth.spfResult, auth.dmarcResult)
+	}
+
 	subject, err := decodeWord(req.Message.Header.Get("Subject"))
 	if err != nil {
 		log.WithError(err).WithField("subject", req.Message.Header.Get("Subject")).Error("smtpmail.handler: failed to decode subject")
@@ -86,11 +192,16 @@ func (h *handler) handler(req *smtpsrv.Request) error {
 	}
 
 	partialMsg := burner.Message{
-		ReceivedAt:      time.Now().Unix(),
-		EmailProviderID: "smtp", // TODO: maybe a better id here? For logging purposes?
-		Sender:          req.From,
-		From:            from,
-		Subject:         subject,
+		ReceivedAt:        time.Now().Unix(),
+		EmailProviderID:   "smtp", // TODO: maybe a better id here? For logging purposes?
+		Sender:            req.From,
+		From:              from,
+		Subject:           subject,
+		SPFResult:         auth.spfResult,
+		DKIMResults:       auth.dkimResults,
+		DMARCResult:       auth.dmarcResult,
+		AuthResultsHeader: auth.header,
+		Hidden:            auth.action == AuthActionQuarantine,
 	}
 
 	cTypeHeader := req.Message.Header.Get("Content-Type")
@@ -104,22 +215,24 @@ func (h *handler) handler(req *smtpsrv.Request) error {
 		return fmt.Errorf("smtp.handler: failed to parse message media type: %w", err)
 	}
 
+	cte := req.Message.Header.Get("Content-Transfer-Encoding")
+
 	if strings.HasPrefix(cType, "text/plain") {
-		bb, err := ioutil.ReadAll(req.Message.Body)
+		bb, err := decodeBody(req.Message.Body, cte, params["charset"])
 		if err != nil {
-			log.WithError(err).Error("smtpmail.handler: failed to read email body")
-			return fmt.Errorf("smtp.handler: failed to read text email body: %w", err)
+			log.WithError(err).Error("smtpmail.handler: failed to decode email body")
+			return fmt.Errorf("smtp.handler: failed to decode text email body: %w", err)
 		}
 
 		partialMsg.BodyPlain = string(bytes.TrimSpace(bb))
 	} else if strings.HasPrefix(cType, "text/html") {
-		bb, err := ioutil.ReadAll(req.Message.Body)
+		bb, err := decodeBody(req.Message.Body, cte, params["charset"])
 		if err != nil {
-			log.WithError(err).Error("smtpmail.handler: failed to read email body")
-			return fmt.Errorf("smtp.handler: failed to read html email body: %w", err)
+			log.WithError(err).Error("smtpmail.handler: failed to decode email body")
+			return fmt.Errorf("smtp.handler: failed to decode html email body: %w", err)
 		}
 
-		modifiedHTML, err := email.AddTargetBlank(string(bb))
+		modifiedHTML, err := email.AddTargetBlank(string(bytes.TrimSpace(bb)))
 		if err != nil {
 			log.WithError(err).Error("smtpmail.handler: failed to AddTargetBlank")
 			return fmt.Errorf("smtp.handler: failed to AddTargetBlank: %w", err)
@@ -135,7 +248,7 @@ func (h *handler) handler(req *smtpsrv.Request) error {
 
 		copyReader := bytes.NewReader(messageCopy)
 
-		text, html, err := extractParts(copyReader, params["boundary"])
+		text, html, attachments, err := extractParts(copyReader, params["boundary"])
 		if err != nil {
 			log.WithError(err).WithField("message", string(messageCopy)).Error("smtpmail.handler: failed to parse multipart")
 			return err
@@ -143,6 +256,7 @@ func (h *handler) handler(req *smtpsrv.Request) error {
 
 		partialMsg.BodyPlain = strings.TrimSpace(text)
 		partialMsg.BodyHTML = strings.TrimSpace(html)
+		partialMsg.Attachments = attachments
 	}
 
 	for _, rcpt := range req.To {
@@ -162,54 +276,28 @@ func (h *handler) handler(req *smtpsrv.Request) error {
 		msg.ID = mID.String()
 		msg.InboxID = inbox.ID
 		msg.TTL = inbox.TTL
+		msg.BodyHTML = rewriteCIDRefs(msg.BodyHTML, inbox.ID, msg.ID, msg.Attachments)
+
+		if h.buildRFC822 != nil {
+			msg.RFC822 = h.buildRFC822(msg)
+		}
 
 		err = h.db.SaveNewMessage(msg)
 		if err != nil {
 			log.WithError(err).Error("smtpmail.handler: failed to save message to db")
 			return fmt.Errorf("smtp.handler: failed to save message to db: %w", err)
 		}
-	}
-
-	return nil
-}
-
-func extractParts(r io.Reader, boundary string) (string, string, error) {
-	var text, html string
-	mr := multipart.NewReader(r, boundary)
-
-	for {
-		p, err := mr.NextPart()
-		if err == io.EOF {
-			return text, html, nil
-		} else if err != nil {
-			return "", "", fmt.Errorf("smtp.extractParts: failed to failed to get next part: %w", err)
-		}
-
-		cType := p.Header.Get("Content-Type")
 
-		bb, err := ioutil.ReadAll(p)
-
-		if strings.HasPrefix(cType, "text/plain") {
-			text = string(bb)
-		} else if strings.HasPrefix(cType, "text/html") {
-			trimmed := bytes.TrimSpace(bb)
-			modifiedHTML, err := email.AddTargetBlank(string(trimmed))
-			if err != nil {
-				return "", "", fmt.Errorf("smtp.extractParts: failed to AddTargetBlank: %w", err)
-			}
-
-			html = modifiedHTML
-		} else {
-			continue
+		if h.onNewMessage != nil {
+			h.onNewMessage(inbox.ID)
 		}
 
-		if err != nil {
-			if err == io.ErrUnexpectedEOF {
-				return text, html, nil
-			}
-			return "", "", fmt.Errorf("smtp.extractParts: failed to read email body: %w", err)
+		if h.notify != nil {
+			h.notify(inbox, msg)
 		}
 	}
+
+	return nil
 }
 
 var wordDecoder = new(mime.WordDecoder)